@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/openlab-red/mutating-webhook-vault-agent/internal/engine"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var registerCmd = &cobra.Command{
+	Use:   "register",
+	Short: "Register the MutatingWebhookConfiguration",
+	Long:  `Create or patch the MutatingWebhookConfiguration with the current serving CA bundle`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return engine.Register()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(registerCmd)
+	viper.SetDefault("webhook-register", false)
+	viper.SetDefault("webhook-configuration-name", "vault-agent-webhook")
+	viper.SetDefault("webhook-name", "vault-agent.vaultproject.io")
+	viper.SetDefault("webhook-service-name", "vault-agent-webhook")
+	viper.SetDefault("webhook-service-namespace", "")
+	viper.SetDefault("webhook-service-path", "/mutate")
+	viper.SetDefault("webhook-service-port", 443)
+	viper.SetDefault("webhook-failure-policy", "Fail")
+	viper.SetDefault("webhook-timeout-seconds", 5)
+	viper.SetDefault("webhook-namespace-selector", "sidecar.agent.vaultproject.io/webhook=enabled")
+	viper.SetDefault("webhook-operations", "CREATE,UPDATE")
+	viper.SetDefault("webhook-ca-file", "/var/run/secrets/kubernetes.io/serviceaccount/service-ca.crt")
+	viper.SetDefault("webhook-ca-sync-period", "1m")
+}
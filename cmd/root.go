@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"os"
@@ -25,9 +26,11 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	viper.SetDefault("kubeconfig", "")
 }
 
 func initConfig() {
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
+	kube.SetKubeconfig(viper.GetString("kubeconfig"))
 }
\ No newline at end of file
@@ -18,5 +18,44 @@ var handlerCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(handlerCmd)
 	viper.SetDefault("log-level", "INFO")
+	viper.SetDefault("log-format", "text")
+	viper.SetDefault("log-redact-patterns", []string{
+		`(?i)"?(password|passwd|secret|token|credentials?)[a-z_-]*"?\s*[:=]`,
+		`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`,
+		`-----BEGIN [A-Z ]*PRIVATE KEY-----`,
+	})
 	viper.SetDefault("port", "8080")
+	viper.SetDefault("tls-mode", "file")
+	viper.SetDefault("tls-secret-name", "vault-agent-webhook-self-signed")
+	viper.SetDefault("tls-self-signed-dir", "/tmp/vault-agent-webhook/certs")
+	viper.SetDefault("tls-self-signed-validity", "8760h")
+	viper.SetDefault("tls-self-signed-sync-period", "1m")
+	viper.SetDefault("tls-cert-file", "/var/run/secrets/kubernetes.io/certs/tls.crt")
+	viper.SetDefault("tls-key-file", "/var/run/secrets/kubernetes.io/certs/tls.key")
+	viper.SetDefault("tls-min-version", "1.2")
+	viper.SetDefault("tls-cipher-suites", "")
+	viper.SetDefault("tls-expiry-threshold", "24h")
+	viper.SetDefault("shutdown-drain-period", "5s")
+	viper.SetDefault("shutdown-timeout", "10s")
+	viper.SetDefault("audit-sink", "none")
+	viper.SetDefault("audit-target", "")
+	viper.SetDefault("audit-queue-size", 1000)
+	viper.SetDefault("audit-timeout", "5s")
+	viper.SetDefault("tracing-exporter", "none")
+	viper.SetDefault("tracing-endpoint", "localhost:55680")
+	viper.SetDefault("tracing-sample-ratio", 1.0)
+	viper.SetDefault("informers-resync-period", "10m")
+	viper.SetDefault("admission-budget", "4s")
+	viper.SetDefault("admission-failure-mode", "closed")
+	viper.SetDefault("events", true)
+	viper.SetDefault("events-interval", "1m")
+	viper.SetDefault("ca-bundle-source", "openshift")
+	viper.SetDefault("ca-bundle-namespace", "")
+	viper.SetDefault("ca-bundle-name", "")
+	viper.SetDefault("ca-bundle-key", "service-ca.crt")
+	viper.SetDefault("agent-config-storage", "configmap")
+	viper.SetDefault("agent-run-as-user", "")
+	viper.SetDefault("agent-run-as-group", "")
+	viper.SetDefault("agent-fs-group", "")
+	viper.SetDefault("agent-seccomp-profile", "")
 }
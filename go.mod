@@ -5,10 +5,14 @@ go 1.13
 require (
 	github.com/ghodss/yaml v1.0.0
 	github.com/gin-gonic/gin v1.5.0
+	github.com/prometheus/client_golang v1.5.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.6
 	github.com/spf13/viper v1.6.2
+	go.opentelemetry.io/otel v0.6.0
+	go.opentelemetry.io/otel/exporters/otlp v0.6.0
 	google.golang.org/appengine v1.5.0
+	google.golang.org/grpc v1.27.1
 	k8s.io/api v0.0.0
 	k8s.io/apimachinery v0.0.0
 	k8s.io/client-go v0.0.0
@@ -0,0 +1,322 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// TLSModeFile serves the certificate files provided by the platform, e.g. OpenShift service serving certificates
+	TLSModeFile = "file"
+	// TLSModeSelfSigned generates a CA and a serving certificate stored in a Secret
+	TLSModeSelfSigned = "self-signed"
+
+	caCertKey = "ca.crt"
+)
+
+// certificateFiles defines the location of the serving certificate and its CA
+type certificateFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// servingCertificates returns the certificate files for the configured tls-mode
+func servingCertificates() (*certificateFiles, error) {
+	switch viper.GetString("tls-mode") {
+	case TLSModeFile:
+		return &certificateFiles{
+			certFile: viper.GetString("tls-cert-file"),
+			keyFile:  viper.GetString("tls-key-file"),
+			caFile:   viper.GetString("webhook-ca-file"),
+		}, nil
+	case TLSModeSelfSigned:
+		return bootstrapCertificates()
+	}
+	return nil, fmt.Errorf("Unsupported tls-mode %s, expected %s or %s", viper.GetString("tls-mode"), TLSModeFile, TLSModeSelfSigned)
+}
+
+// bootstrapCertificates loads the self-signed certificates from the Secret shared across replicas,
+// generating them when missing or expiring, and writes them to tls-self-signed-dir
+func bootstrapCertificates() (*certificateFiles, error) {
+	secret, err := selfSignedSecret()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Using self-signed certificate from Secret %s/%s", secret.Namespace, secret.Name)
+
+	dir := viper.GetString("tls-self-signed-dir")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files := &certificateFiles{
+		certFile: filepath.Join(dir, corev1.TLSCertKey),
+		keyFile:  filepath.Join(dir, corev1.TLSPrivateKeyKey),
+		caFile:   filepath.Join(dir, caCertKey),
+	}
+	for file, key := range map[string]string{
+		files.certFile: corev1.TLSCertKey,
+		files.keyFile:  corev1.TLSPrivateKeyKey,
+		files.caFile:   caCertKey,
+	} {
+		if _, err := writeIfChanged(file, secret.Data[key]); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// syncSelfSigned keeps the files of every replica in sync with the Secret, renewing the certificate before it expires.
+// The CA bundle is written first, the serving certificate is switched once syncRegistration registered the bundle
+// trusting its CA.
+func syncSelfSigned(files *certificateFiles, stop <-chan struct{}) {
+	ticker := time.NewTicker(viper.GetDuration("tls-self-signed-sync-period"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		secret, err := selfSignedSecret()
+		if err != nil {
+			log.Errorf("Failed to refresh the self-signed certificate: %v", err)
+			continue
+		}
+
+		caBundle := secret.Data[caCertKey]
+		if _, err := writeIfChanged(files.caFile, caBundle); err != nil {
+			log.Errorf("Failed to write %s: %v", files.caFile, err)
+			continue
+		}
+		if registered, _ := registeredCA.Load().([]byte); !bytes.Equal(registered, caBundle) {
+			log.Infof("Waiting for the CA bundle registration to switch the serving certificate")
+			continue
+		}
+
+		for file, key := range map[string]string{
+			files.certFile: corev1.TLSCertKey,
+			files.keyFile:  corev1.TLSPrivateKeyKey,
+		} {
+			changed, err := writeIfChanged(file, secret.Data[key])
+			if err != nil {
+				log.Errorf("Failed to write %s: %v", file, err)
+			} else if changed {
+				log.Infof("Self-signed certificate %s updated from Secret %s/%s", file, secret.Namespace, secret.Name)
+			}
+		}
+	}
+}
+
+// writeIfChanged writes the file unless it already has the content, the reloader watches the modification time
+func writeIfChanged(file string, data []byte) (bool, error) {
+	current, err := ioutil.ReadFile(file)
+	if err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	return true, ioutil.WriteFile(file, data, 0600)
+}
+
+// selfSignedSecret returns a valid certificate Secret, the first replica creating or renewing it wins.
+// Only the Secrets labelled as managed by the webhook are renewed.
+func selfSignedSecret() (*corev1.Secret, error) {
+	client, err := kube.NewClient()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := viper.GetString("webhook-service-namespace")
+	if namespace == "" {
+		namespace = kube.Namespace()
+	}
+	return sharedSelfSigned(client.CoreV1().Secrets(namespace), namespace, viper.GetString("tls-secret-name"))
+}
+
+// sharedSelfSigned reads the Secret again when another replica created or renewed it meanwhile
+func sharedSelfSigned(secrets corev1client.SecretInterface, namespace, name string) (secret *corev1.Secret, err error) {
+	err = retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		var err error
+		secret, err = refreshSelfSigned(secrets, namespace, name)
+		return err
+	})
+	return secret, err
+}
+
+func refreshSelfSigned(secrets corev1client.SecretInterface, namespace, name string) (*corev1.Secret, error) {
+	current, err := secrets.Get(name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+	if exists && validSelfSigned(current) {
+		return current, nil
+	}
+
+	data, err := generateCertificates(serviceDNSNames(viper.GetString("webhook-service-name"), namespace), viper.GetDuration("tls-self-signed-validity"))
+	if err != nil {
+		return nil, err
+	}
+
+	if exists && current.Labels[kube.ManagedByLabel] != kube.ManagedByValue {
+		// e.g. the Secret of the OpenShift service serving certificates, both would keep overwriting the other
+		return nil, fmt.Errorf("Secret %s/%s is not managed by the webhook, set tls-secret-name to another Secret or label it %s=%s",
+			namespace, name, kube.ManagedByLabel, kube.ManagedByValue)
+	}
+
+	if exists {
+		// the replicas still serving the previous certificate stay trusted until they switch to the renewed one
+		data[caCertKey] = append(data[caCertKey], previousCA(current)...)
+		current.Data = data
+		log.Infof("Renewing self-signed certificate in Secret %s/%s", namespace, name)
+		return secrets.Update(current)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/instance": viper.GetString("webhook-service-name"),
+				"app.kubernetes.io/name":     viper.GetString("webhook-service-name"),
+				kube.ManagedByLabel:          kube.ManagedByValue,
+			},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: data,
+	}
+	created, err := secrets.Create(secret)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Self-signed certificate stored in Secret %s/%s", namespace, name)
+	return created, nil
+}
+
+// previousCA returns the CA that signed the certificate being renewed, the first of the bundle, unless it expired
+func previousCA(secret *corev1.Secret) []byte {
+	block, _ := pem.Decode(secret.Data[caCertKey])
+	if block == nil {
+		return nil
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil || time.Now().After(ca.NotAfter) {
+		return nil
+	}
+	return pem.EncodeToMemory(block)
+}
+
+// validSelfSigned verifies the Secret contains a key pair not expiring within twice tls-expiry-threshold,
+// the certificate is renewed before the readiness starts failing
+func validSelfSigned(secret *corev1.Secret) bool {
+	if len(secret.Data[caCertKey]) == 0 {
+		return false
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return false
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	return time.Now().Add(2 * viper.GetDuration("tls-expiry-threshold")).Before(leaf.NotAfter)
+}
+
+// serviceDNSNames returns the DNS names the API server uses to call the service
+func serviceDNSNames(service, namespace string) []string {
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+// generateCertificates creates a CA and a serving certificate signed by it, returned as Secret data
+func generateCertificates(dnsNames []string, validity time.Duration) (map[string][]byte, error) {
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "vault-agent-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		caCertKey:               pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+func serialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
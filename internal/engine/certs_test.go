@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	"github.com/spf13/viper"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testNamespace = "vault-agent-webhook"
+	testSecret    = "vault-agent-webhook-self-signed"
+)
+
+func expiringSecret(t *testing.T) *corev1.Secret {
+	t.Helper()
+	data, err := generateCertificates(serviceDNSNames("vault-agent-webhook", testNamespace), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testSecret,
+			Namespace: testNamespace,
+			Labels:    map[string]string{kube.ManagedByLabel: kube.ManagedByValue},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: data,
+	}
+}
+
+func TestRenewKeepsPreviousCA(t *testing.T) {
+	viper.Set("webhook-service-name", "vault-agent-webhook")
+	viper.Set("tls-self-signed-validity", 48*time.Hour)
+	viper.Set("tls-expiry-threshold", 2*time.Hour)
+
+	previous := expiringSecret(t)
+	client := fake.NewSimpleClientset(previous.DeepCopy())
+
+	renewed, err := sharedSelfSigned(client.CoreV1().Secrets(testNamespace), testNamespace, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validSelfSigned(renewed) {
+		t.Fatal("the expiring certificate has not been renewed")
+	}
+
+	bundle := x509.NewCertPool()
+	if !bundle.AppendCertsFromPEM(renewed.Data[caCertKey]) {
+		t.Fatal("invalid renewed CA bundle")
+	}
+	if cas := len(bundle.Subjects()); cas != 2 {
+		t.Fatalf("renewed CA bundle has %d CAs, expected the renewed and the previous one", cas)
+	}
+	for name, secret := range map[string]*corev1.Secret{"previous": previous, "renewed": renewed} {
+		block, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "vault-agent-webhook." + testNamespace + ".svc", Roots: bundle}); err != nil {
+			t.Errorf("%s certificate not trusted by the renewed CA bundle: %v", name, err)
+		}
+	}
+}
+
+func TestRenewConflictReadsTheOtherReplicaCertificate(t *testing.T) {
+	viper.Set("webhook-service-name", "vault-agent-webhook")
+	viper.Set("tls-self-signed-validity", 48*time.Hour)
+	viper.Set("tls-expiry-threshold", 2*time.Hour)
+
+	client := fake.NewSimpleClientset(expiringSecret(t))
+	other, err := generateCertificates(serviceDNSNames("vault-agent-webhook", testNamespace), 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates := 0
+	client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		// another replica renews the certificate first
+		secret := expiringSecret(t)
+		secret.Data = other
+		if err := client.Tracker().Update(schema.GroupVersionResource{Version: "v1", Resource: "secrets"}, secret, testNamespace); err != nil {
+			t.Fatal(err)
+		}
+		return true, nil, errors.NewConflict(schema.GroupResource{Resource: "secrets"}, testSecret, nil)
+	})
+
+	secret, err := sharedSelfSigned(client.CoreV1().Secrets(testNamespace), testNamespace, testSecret)
+	if err != nil {
+		t.Fatalf("conflict not retried: %v", err)
+	}
+	if updates != 1 {
+		t.Errorf("%d updates, expected the conflicting one only", updates)
+	}
+	if string(secret.Data[corev1.TLSCertKey]) != string(other[corev1.TLSCertKey]) {
+		t.Error("the certificate renewed by the other replica is not used")
+	}
+}
+
+func TestRenewRefusesUnmanagedSecret(t *testing.T) {
+	viper.Set("webhook-service-name", "vault-agent-webhook")
+	viper.Set("tls-self-signed-validity", 48*time.Hour)
+	viper.Set("tls-expiry-threshold", 2*time.Hour)
+
+	// e.g. the service serving certificate, without ca.crt
+	unmanaged := expiringSecret(t)
+	unmanaged.Labels = nil
+	delete(unmanaged.Data, caCertKey)
+	client := fake.NewSimpleClientset(unmanaged.DeepCopy())
+
+	if _, err := sharedSelfSigned(client.CoreV1().Secrets(testNamespace), testNamespace, testSecret); err == nil {
+		t.Fatal("unmanaged Secret renewed")
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("unmanaged Secret updated")
+		}
+	}
+}
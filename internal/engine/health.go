@@ -1,9 +1,99 @@
 package engine
 
-import "github.com/gin-gonic/gin"
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthCheck defines a named check reported by the health endpoints
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// healthStatus defines the result of a check
+type healthStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
 
 func health(c *gin.Context) {
+	if !isReady() {
+		c.JSON(503, gin.H{
+			"status": "DOWN",
+		})
+		return
+	}
 	c.JSON(200, gin.H{
 		"status": "UP",
 	})
 }
+
+// healthHandler runs the checks, the details of every check are returned with the verbose query parameter
+func healthHandler(checks []healthCheck) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		code := http.StatusOK
+		status := "UP"
+		var details []healthStatus
+
+		for _, hc := range checks {
+			result := healthStatus{Name: hc.name, Status: "UP"}
+			if err := hc.check(); err != nil {
+				code = http.StatusServiceUnavailable
+				status = "DOWN"
+				result.Status = "DOWN"
+				result.Error = err.Error()
+				log.Warnf("Health check %s failed: %v", hc.name, err)
+			}
+			details = append(details, result)
+		}
+
+		if _, verbose := c.GetQuery("verbose"); verbose {
+			c.JSON(code, gin.H{
+				"status": status,
+				"checks": details,
+			})
+			return
+		}
+		c.JSON(code, gin.H{
+			"status": status,
+		})
+	}
+}
+
+func pingCheck() error {
+	return nil
+}
+
+func shutdownCheck() error {
+	if !isReady() {
+		return fmt.Errorf("server is shutting down")
+	}
+	return nil
+}
+
+// certificateCheck verifies the certificate files exist and the served certificate is not expiring within threshold
+func certificateCheck(reloader *certificateReloader, threshold time.Duration) func() error {
+	return func() error {
+		if _, err := reloader.lastModified(); err != nil {
+			return err
+		}
+		cert := reloader.Certificate()
+		if cert == nil || len(cert.Certificate) == 0 {
+			return fmt.Errorf("no certificate loaded")
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		if time.Now().Add(threshold).After(leaf.NotAfter) {
+			return fmt.Errorf("certificate %s expires at %s", reloader.certFile, leaf.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
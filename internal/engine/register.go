@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/internal/webhook"
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	"github.com/spf13/viper"
+)
+
+// registeredCA holds the CA bundle last registered by syncRegistration
+var registeredCA atomic.Value
+
+// Register creates or patches the MutatingWebhookConfiguration with the current CA bundle
+func Register() error {
+	files, err := servingCertificates()
+	if err != nil {
+		return err
+	}
+	caBundle, err := ioutil.ReadFile(files.caFile)
+	if err != nil {
+		return err
+	}
+	return registration().Register(caBundle)
+}
+
+func registration() *webhook.Registration {
+	namespace := viper.GetString("webhook-service-namespace")
+	if namespace == "" {
+		namespace = kube.Namespace()
+	}
+
+	return &webhook.Registration{
+		Name:              viper.GetString("webhook-configuration-name"),
+		WebhookName:       viper.GetString("webhook-name"),
+		ServiceName:       viper.GetString("webhook-service-name"),
+		ServiceNamespace:  namespace,
+		ServicePath:       viper.GetString("webhook-service-path"),
+		ServicePort:       viper.GetInt32("webhook-service-port"),
+		FailurePolicy:     viper.GetString("webhook-failure-policy"),
+		TimeoutSeconds:    viper.GetInt32("webhook-timeout-seconds"),
+		NamespaceSelector: viper.GetString("webhook-namespace-selector"),
+		Operations:        strings.Split(viper.GetString("webhook-operations"), ","),
+	}
+}
+
+// syncRegistration registers the webhook and keeps the caBundle in sync when the CA file changes
+func syncRegistration(file string, stop <-chan struct{}) {
+	var current []byte
+	reg := registration()
+
+	ticker := time.NewTicker(viper.GetDuration("webhook-ca-sync-period"))
+	defer ticker.Stop()
+
+	for {
+		caBundle, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf("Unable to read CA bundle %s: %v", file, err)
+		} else if !bytes.Equal(caBundle, current) {
+			if err := reg.Register(caBundle); err != nil {
+				log.Errorf("Failed to register webhook: %v", err)
+			} else {
+				current = caBundle
+				registeredCA.Store(caBundle)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -5,37 +5,74 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/openlab-red/mutating-webhook-vault-agent/internal/logrus"
 	"github.com/spf13/viper"
 )
 
-var log = logrus.Log()
+var (
+	log = logrus.Log()
 
-func shutdown(engine *gin.Engine) {
-	srv := &http.Server{
-		Addr:    viper.GetString("port"),
-		Handler: engine,
+	// ready is set while the server accepts new admissions
+	ready int32
+)
+
+func setReady(value bool) {
+	if value {
+		atomic.StoreInt32(&ready, 1)
+	} else {
+		atomic.StoreInt32(&ready, 0)
 	}
+}
 
+func isReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// serve runs the server until it fails or a termination signal is received, then shuts it down gracefully
+func serve(srv *http.Server, listen func() error) {
+	errs := make(chan error, 1)
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Listen: %s\n", err)
-		}
+		errs <- listen()
 	}()
 
-	quit := make(chan os.Signal)
+	// buffered, signal.Notify does not block when the signal is delivered before the select
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	defer signal.Stop(quit)
+	setReady(true)
+
+	select {
+	case err := <-errs:
+		setReady(false)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Listen: %s\n", err)
+		}
+		return
+	case sig := <-quit:
+		log.Infof("Received %s, shutdown Server ...", sig)
+	}
+
+	shutdown(srv)
+}
+
+// shutdown turns the readiness down, waits the drain period so the endpoints are updated,
+// then stops the server letting the in-flight admissions complete
+func shutdown(srv *http.Server) {
+	setReady(false)
 
-	log.Println("Shutdown Server ...")
+	drain := viper.GetDuration("shutdown-drain-period")
+	log.Infof("Draining connections for %s", drain)
+	time.Sleep(drain)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown-timeout"))
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server Shutdown:", err)
+		log.Errorln("Server Shutdown:", err)
+		return
 	}
+	log.Infoln("Server exited")
 }
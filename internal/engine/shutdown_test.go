@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestServeGracefulShutdown(t *testing.T) {
+	drain, timeout := 300*time.Millisecond, 5*time.Second
+	viper.Set("shutdown-drain-period", drain)
+	viper.Set("shutdown-timeout", timeout)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(drain + 500*time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	srv := &http.Server{Handler: mux}
+
+	served := make(chan struct{})
+	go func() {
+		serve(srv, func() error {
+			return srv.Serve(listener)
+		})
+		close(served)
+	}()
+	waitFor(t, "server ready", isReady)
+
+	type result struct {
+		body string
+		err  error
+	}
+	inflight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			inflight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		inflight <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	signalled := time.Now()
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "readiness failing", func() bool { return !isReady() })
+
+	select {
+	case res := <-inflight:
+		if res.err != nil {
+			t.Fatalf("in-flight request failed: %v", res.err)
+		}
+		if res.body != "done" {
+			t.Fatalf("in-flight request returned %q", res.body)
+		}
+	case <-time.After(drain + timeout):
+		t.Fatal("in-flight request did not complete")
+	}
+
+	select {
+	case <-served:
+	case <-time.After(drain + timeout):
+		t.Fatal("serve did not return within the grace period")
+	}
+	if elapsed := time.Since(signalled); elapsed >= drain+timeout {
+		t.Fatalf("serve returned after %s, grace period %s", elapsed, drain+timeout)
+	}
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,9 +1,15 @@
 package engine
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/openlab-red/mutating-webhook-vault-agent/internal/logrus"
+	"github.com/openlab-red/mutating-webhook-vault-agent/internal/tracing"
 	"github.com/openlab-red/mutating-webhook-vault-agent/internal/webhook"
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 )
 
@@ -13,24 +19,150 @@ func Start() {
 
 	logrus.InitLogrus(engine)
 
+	files, err := servingCertificates()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	reloader, err := newCertificateReloader(files.certFile, files.keyFile)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	flush, err := tracing.Init(viper.GetString("tracing-exporter"), viper.GetString("tracing-endpoint"), viper.GetFloat64("tracing-sample-ratio"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer flush()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	wk := hook(engine)
+	defer wk.Auditor.Close()
+
+	// the admissions read from the API server until the caches are synced
+	wk.Informers.Start(stop)
+
 	engine.GET("/health", health)
+	engine.GET("/livez", healthHandler([]healthCheck{
+		{"ping", pingCheck},
+	}))
+	engine.GET("/readyz", healthHandler([]healthCheck{
+		{"shutdown", shutdownCheck},
+		{"sidecar-config", wk.SidecarConfig.Check},
+		{"certificate", certificateCheck(reloader, viper.GetDuration("tls-expiry-threshold"))},
+		{"kubernetes", kube.Ping},
+		{"informers", wk.Informers.Synced},
+	}))
+	engine.GET("/metrics", gin.WrapH(promhttp.Handler()))
+
+	config, err := tlsConfig(reloader)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
-	hook(engine)
+	// the self-signed CA is only known by the webhook, it has to be injected into the configuration
+	if viper.GetBool("webhook-register") || viper.GetString("tls-mode") == TLSModeSelfSigned {
+		go syncRegistration(files.caFile, stop)
+	}
+	if viper.GetString("tls-mode") == TLSModeSelfSigned {
+		go syncSelfSigned(files, stop)
+	}
 
-	engine.RunTLS(":"+viper.GetString("port"), "/var/run/secrets/kubernetes.io/certs/tls.crt", "/var/run/secrets/kubernetes.io/certs/tls.key")
+	srv := &http.Server{
+		Addr:      ":" + viper.GetString("port"),
+		Handler:   engine,
+		TLSConfig: config,
+	}
 
-	shutdown(engine)
+	serve(srv, func() error {
+		return srv.ListenAndServeTLS("", "")
+	})
 }
 
-func hook(engine *gin.Engine) {
+func hook(engine *gin.Engine) *webhook.WebHook {
 
 	sidecarConfig := webhook.SidecarConfig{}
-	webhook.Load("/var/run/secrets/kubernetes.io/config/sidecarconfig.yaml", &sidecarConfig)
+	if err := webhook.Load("/var/run/secrets/kubernetes.io/config/sidecarconfig.yaml", &sidecarConfig); err != nil {
+		// the readiness reports the failure, the admissions are rejected until the config is fixed
+		log.Errorln(err)
+	}
+
+	client, err := kube.NewClient()
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	wk := webhook.WebHook{
 		SidecarConfig: &sidecarConfig,
+		Client:        client,
+		Informers:     kube.NewInformers(client, viper.GetDuration("informers-resync-period")),
+		Budget:        viper.GetDuration("admission-budget"),
+		FailureMode:   viper.GetString("admission-failure-mode"),
+		ConfigStorage: viper.GetString("agent-config-storage"),
+		SecurityContext: webhook.SidecarSecurityContext{
+			RunAsUser:      optionalInt64("agent-run-as-user"),
+			RunAsGroup:     optionalInt64("agent-run-as-group"),
+			FSGroup:        optionalInt64("agent-fs-group"),
+			SeccompProfile: viper.GetString("agent-seccomp-profile"),
+		},
+		CABundle: webhook.CABundleSource{
+			Source:    viper.GetString("ca-bundle-source"),
+			Namespace: viper.GetString("ca-bundle-namespace"),
+			Name:      viper.GetString("ca-bundle-name"),
+			Key:       viper.GetString("ca-bundle-key"),
+		},
+	}
+	sink, err := webhook.NewAuditSink(viper.GetString("audit-sink"), viper.GetString("audit-target"), viper.GetDuration("audit-timeout"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if sink != nil {
+		wk.Auditor = webhook.NewAuditor(sink, viper.GetInt("audit-queue-size"))
+	}
+
+	if viper.GetBool("events") {
+		recorder, err := kube.EventRecorder("vault-agent-webhook")
+		if err != nil {
+			log.Errorf("Kubernetes Events disabled: %v", err)
+		} else {
+			wk.Events = webhook.NewEventNotifier(recorder, viper.GetDuration("events-interval"))
+		}
+	}
+
+	redactor, err := webhook.NewRedactor(viper.GetStringSlice("log-redact-patterns"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	wk.Redactor = redactor
+
+	if wk.CABundle.Namespace == "" {
+		wk.CABundle.Namespace = kube.Namespace()
+	}
+	if err := wk.CABundle.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := webhook.ValidateFailureMode(wk.FailureMode); err != nil {
+		log.Fatalln(err)
+	}
+	if err := webhook.ValidateConfigStorage(wk.ConfigStorage); err != nil {
+		log.Fatalln(err)
+	}
+	if timeout := time.Duration(viper.GetInt("webhook-timeout-seconds")) * time.Second; wk.Budget >= timeout {
+		log.Warnf("Admission budget %s is not lower than the webhook timeout %s, the API server may give up first", wk.Budget, timeout)
 	}
 
 	engine.POST("/mutate", wk.Mutate)
 
+	return &wk
+}
+
+// optionalInt64 returns nil when the setting is not defined
+func optionalInt64(key string) *int64 {
+	if viper.GetString(key) == "" {
+		return nil
+	}
+	value := viper.GetInt64(key)
+	return &value
 }
@@ -13,6 +13,16 @@ var log = logrus.New()
 // GIN placeholder for GIN logs
 const GIN = "[GIN]"
 
+// Field names shared by the admission logs
+const (
+	FieldUID       = "uid"
+	FieldNamespace = "namespace"
+	FieldPod       = "pod"
+	FieldOwner     = "owner"
+	FieldOperation = "operation"
+	FieldUser      = "user"
+)
+
 // InitLogrus initialise the log from LogRus
 func InitLogrus(engine *gin.Engine) {
 	level, err := logrus.ParseLevel(viper.GetString("log-level"))
@@ -21,9 +31,16 @@ func InitLogrus(engine *gin.Engine) {
 	} else {
 		log.Level = level
 	}
-	log.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-	})
+	switch viper.GetString("log-format") {
+	case "json":
+		log.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		log.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+		})
+	default:
+		log.Fatalf("Unsupported log-format %s, expected text or json", viper.GetString("log-format"))
+	}
 	engine.Use(LoggerWithLogrus(log))
 
 }
@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/trace/stdout"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// ExporterNone disables the tracing
+	ExporterNone = "none"
+	// ExporterStdout writes the spans as JSON to the standard output, useful to test locally
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends the spans to an OpenTelemetry collector
+	ExporterOTLP = "otlp"
+
+	tracerName = "github.com/openlab-red/mutating-webhook-vault-agent"
+)
+
+// Init configures the global trace provider, the returned function flushes and stops the exporter
+func Init(exporter, endpoint string, sampleRatio float64) (func(), error) {
+	config := sdktrace.WithConfig(sdktrace.Config{
+		DefaultSampler: sdktrace.ProbabilitySampler(sampleRatio),
+	})
+
+	switch exporter {
+	case ExporterNone, "":
+		return func() {}, nil
+	case ExporterStdout:
+		exp, err := stdout.NewExporter(stdout.Options{})
+		if err != nil {
+			return nil, err
+		}
+		provider, err := sdktrace.NewProvider(config, sdktrace.WithSyncer(exp))
+		if err != nil {
+			return nil, err
+		}
+		global.SetTraceProvider(provider)
+		return func() {}, nil
+	case ExporterOTLP:
+		exp, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(endpoint))
+		if err != nil {
+			return nil, err
+		}
+		processor, err := sdktrace.NewBatchSpanProcessor(exp)
+		if err != nil {
+			return nil, err
+		}
+		provider, err := sdktrace.NewProvider(config)
+		if err != nil {
+			return nil, err
+		}
+		provider.RegisterSpanProcessor(processor)
+		global.SetTraceProvider(provider)
+		return func() {
+			processor.Shutdown()
+			_ = exp.Stop()
+		}, nil
+	}
+	return nil, fmt.Errorf("Unsupported trace exporter %s, expected %s, %s or %s", exporter, ExporterNone, ExporterStdout, ExporterOTLP)
+}
+
+// Extract returns the context carrying the span propagated by the caller in the request headers
+func Extract(req *http.Request) context.Context {
+	return propagation.ExtractHTTP(req.Context(), global.Propagators(), req.Header)
+}
+
+// Start creates a span child of the span carried by ctx
+func Start(ctx context.Context, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	return global.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records the error, if any, and ends the span
+func End(ctx context.Context, span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.SetStatus(codes.Unknown, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,5 @@
+package version
+
+// Version of the webhook, overridden at build time with
+// -ldflags "-X github.com/openlab-red/mutating-webhook-vault-agent/internal/version.Version=<version>"
+var Version = "dev"
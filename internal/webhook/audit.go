@@ -0,0 +1,208 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// AuditSinkNone disables the audit
+	AuditSinkNone = "none"
+	// AuditSinkStdout writes the audit records as JSON lines to the standard output
+	AuditSinkStdout = "stdout"
+	// AuditSinkFile appends the audit records as JSON lines to a file
+	AuditSinkFile = "file"
+	// AuditSinkHTTP posts every audit record as JSON to an endpoint
+	AuditSinkHTTP = "http"
+)
+
+// AuditRecord defines the audit event of an admission decision
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	UID        string    `json:"uid"`
+	User       string    `json:"user"`
+	Namespace  string    `json:"namespace"`
+	Pod        string    `json:"pod"`
+	Owner      string    `json:"owner"`
+	Operation  string    `json:"operation"`
+	Role       string    `json:"role"`
+	Secrets    []string  `json:"secrets"`
+	Outcome    string    `json:"outcome"`
+	Message    string    `json:"message,omitempty"`
+	ConfigHash string    `json:"configHash"`
+}
+
+// AuditSink writes the audit records
+type AuditSink interface {
+	Write(record *AuditRecord) error
+	Close() error
+}
+
+// Auditor queues the audit records and writes them asynchronously,
+// records are dropped when the queue is full so the admission latency is unaffected
+type Auditor struct {
+	sink  AuditSink
+	queue chan *AuditRecord
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewAuditor creates an Auditor writing to the sink through a queue of the given size
+func NewAuditor(sink AuditSink, size int) *Auditor {
+	a := &Auditor{
+		sink:  sink,
+		queue: make(chan *AuditRecord, size),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+	for record := range a.queue {
+		if err := a.sink.Write(record); err != nil {
+			log.Errorf("Failed to write audit record %s: %v", record.UID, err)
+		}
+	}
+}
+
+// Record queues the record without blocking
+func (a *Auditor) Record(record *AuditRecord) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.queue <- record:
+	default:
+		log.Warnf("Audit queue full, record %s dropped", record.UID)
+	}
+}
+
+// Close flushes the queued records and closes the sink
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.once.Do(func() {
+		close(a.queue)
+	})
+	<-a.done
+	return a.sink.Close()
+}
+
+// NewAuditSink creates the sink of the given kind, target is the file path or the endpoint url
+func NewAuditSink(kind, target string, timeout time.Duration) (AuditSink, error) {
+	switch kind {
+	case AuditSinkNone, "":
+		return nil, nil
+	case AuditSinkStdout:
+		return &writerSink{writer: os.Stdout}, nil
+	case AuditSinkFile:
+		file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return &writerSink{writer: file, closer: file}, nil
+	case AuditSinkHTTP:
+		if target == "" {
+			return nil, fmt.Errorf("Audit sink %s requires an url", kind)
+		}
+		return &httpSink{url: target, client: &http.Client{Timeout: timeout}}, nil
+	}
+	return nil, fmt.Errorf("Unsupported audit sink %s, expected %s, %s, %s or %s", kind, AuditSinkNone, AuditSinkStdout, AuditSinkFile, AuditSinkHTTP)
+}
+
+// writerSink writes the records as JSON lines
+type writerSink struct {
+	writer io.Writer
+	closer io.Closer
+}
+
+func (s *writerSink) Write(record *AuditRecord) error {
+	return json.NewEncoder(s.writer).Encode(record)
+}
+
+func (s *writerSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// httpSink posts every record to an endpoint
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpSink) Write(record *AuditRecord) error {
+	ba, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(ba))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Audit endpoint %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+// audit records the admission decision
+func (wk *WebHook) audit(req *v1.AdmissionRequest, pod *corev1.Pod, response *v1.AdmissionResponse) {
+	if wk.Auditor == nil || response == nil {
+		return
+	}
+
+	record := &AuditRecord{
+		Time:       time.Now().UTC(),
+		UID:        string(req.UID),
+		User:       req.UserInfo.Username,
+		Namespace:  pod.Namespace,
+		Pod:        pod.Name,
+		Owner:      PodOwner(pod),
+		Operation:  string(req.Operation),
+		Role:       GetAnnotationValue(*pod, annotationVaultRole, DefaultVaultRole),
+		Outcome:    auditOutcome(req, response),
+		ConfigHash: wk.SidecarConfig.Hash,
+	}
+	if secret := GetAnnotationValue(*pod, annotationSecret, ""); secret != "" {
+		record.Secrets = []string{secret}
+	}
+	if response.Result != nil {
+		record.Message = response.Result.Message
+	}
+
+	wk.Auditor.Record(record)
+}
+
+func auditOutcome(req *v1.AdmissionRequest, response *v1.AdmissionResponse) string {
+	switch {
+	case !response.Allowed:
+		return "rejected"
+	case response.Result != nil:
+		return "degraded"
+	case len(response.Patch) == 0:
+		return "skipped"
+	case req.Operation == v1.Update:
+		return "updated"
+	}
+	return "injected"
+}
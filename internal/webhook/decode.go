@@ -0,0 +1,245 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// strictUnmarshal decodes yaml into target rejecting unknown or misspelled fields, reported from fldPath
+func strictUnmarshal(data []byte, target interface{}, fldPath *field.Path) error {
+	raw, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return err
+	}
+	if err := checkFields(reflect.TypeOf(target), generic, fldPath); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
+
+// checkFields walks the decoded value and verifies every key matches exactly a json field of the type,
+// encoding/json matches the keys case insensitive, e.g. RunAsUser would be accepted as runAsUser
+func checkFields(t reflect.Type, value interface{}, fldPath *field.Path) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		for key, v := range object {
+			ft, ok := fields[key]
+			if !ok {
+				return unknownField(fldPath.Child(key), key, fields)
+			}
+			if err := checkFields(ft, v, fldPath.Child(key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, v := range list {
+			if err := checkFields(t.Elem(), v, fldPath.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, v := range object {
+			if err := checkFields(t.Elem(), v, fldPath.Key(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonFields returns the json field names of a struct, including the inlined embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			for k, v := range jsonFields(ft) {
+				fields[k] = v
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// unknownField reports an unknown key, hinting the field with the right case if any
+func unknownField(fldPath *field.Path, key string, fields map[string]reflect.Type) *field.Error {
+	for name := range fields {
+		if strings.EqualFold(name, key) {
+			return field.Invalid(fldPath, key, fmt.Sprintf("unknown field, did you mean %s", name))
+		}
+	}
+	return field.Invalid(fldPath, key, "unknown field")
+}
+
+// validateSidecarInject validates the injected containers and volumes
+func validateSidecarInject(sic *SidecarInject, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	volumes := make(map[string]bool)
+	for i, volume := range sic.Volumes {
+		idxPath := fldPath.Child("volumes").Index(i)
+		allErrs = append(allErrs, validateDNS1123Label(volume.Name, idxPath.Child("name"))...)
+		if volumes[volume.Name] {
+			allErrs = append(allErrs, field.Duplicate(idxPath.Child("name"), volume.Name))
+		}
+		volumes[volume.Name] = true
+	}
+
+	allErrs = append(allErrs, validateVolumeMounts(sic.VolumeMount, volumes, fldPath.Child("volumeMounts"))...)
+
+	names := make(map[string]bool)
+	allErrs = append(allErrs, validateContainers(sic.InitContainers, names, fldPath.Child("initContainers"))...)
+	allErrs = append(allErrs, validateContainers(sic.Containers, names, fldPath.Child("containers"))...)
+
+	return allErrs
+}
+
+func validateContainers(containers []corev1.Container, names map[string]bool, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	for i, container := range containers {
+		idxPath := fldPath.Index(i)
+		allErrs = append(allErrs, validateDNS1123Label(container.Name, idxPath.Child("name"))...)
+		if names[container.Name] {
+			allErrs = append(allErrs, field.Duplicate(idxPath.Child("name"), container.Name))
+		}
+		names[container.Name] = true
+
+		if container.Image == "" {
+			allErrs = append(allErrs, field.Required(idxPath.Child("image"), ""))
+		}
+
+		for j, port := range container.Ports {
+			portPath := idxPath.Child("ports").Index(j)
+			for _, msg := range validation.IsValidPortNum(int(port.ContainerPort)) {
+				allErrs = append(allErrs, field.Invalid(portPath.Child("containerPort"), port.ContainerPort, msg))
+			}
+			if port.Name != "" {
+				for _, msg := range validation.IsValidPortName(port.Name) {
+					allErrs = append(allErrs, field.Invalid(portPath.Child("name"), port.Name, msg))
+				}
+			}
+		}
+
+		for j, env := range container.Env {
+			for _, msg := range validation.IsEnvVarName(env.Name) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("env").Index(j).Child("name"), env.Name, msg))
+			}
+		}
+
+		allErrs = append(allErrs, validateVolumeMounts(container.VolumeMounts, nil, idxPath.Child("volumeMounts"))...)
+	}
+
+	return allErrs
+}
+
+// validateVolumeMounts validates the mounts, when volumes is not nil the mount must refer to one of them
+func validateVolumeMounts(mounts []corev1.VolumeMount, volumes map[string]bool, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	paths := make(map[string]bool)
+	for i, mount := range mounts {
+		idxPath := fldPath.Index(i)
+		if mount.Name == "" {
+			allErrs = append(allErrs, field.Required(idxPath.Child("name"), ""))
+		} else if volumes != nil && !volumes[mount.Name] {
+			allErrs = append(allErrs, field.NotFound(idxPath.Child("name"), mount.Name))
+		}
+		if mount.MountPath == "" {
+			allErrs = append(allErrs, field.Required(idxPath.Child("mountPath"), ""))
+		} else if !path.IsAbs(mount.MountPath) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("mountPath"), mount.MountPath, "must be an absolute path"))
+		}
+		if mount.SubPath != "" {
+			allErrs = append(allErrs, validateSubPath(mount.SubPath, idxPath.Child("subPath"))...)
+		}
+		if paths[mount.MountPath] {
+			allErrs = append(allErrs, field.Duplicate(idxPath.Child("mountPath"), mount.MountPath))
+		}
+		paths[mount.MountPath] = true
+	}
+
+	return allErrs
+}
+
+// validateSubPath requires a relative path not escaping the volume
+func validateSubPath(subPath string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if path.IsAbs(subPath) {
+		allErrs = append(allErrs, field.Invalid(fldPath, subPath, "must be a relative path"))
+	}
+	for _, item := range strings.Split(subPath, "/") {
+		if item == ".." {
+			allErrs = append(allErrs, field.Invalid(fldPath, subPath, "must not contain '..'"))
+			break
+		}
+	}
+	return allErrs
+}
+
+func validateDNS1123Label(value string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if value == "" {
+		return append(allErrs, field.Required(fldPath, ""))
+	}
+	for _, msg := range validation.IsDNS1123Label(value) {
+		allErrs = append(allErrs, field.Invalid(fldPath, value, msg))
+	}
+	return allErrs
+}
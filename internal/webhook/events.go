@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// EventReasonInjected reports the vault agent injection
+	EventReasonInjected = "VaultAgentInjected"
+	// EventReasonUpdated reports the vault agent config regeneration
+	EventReasonUpdated = "VaultAgentConfigUpdated"
+	// EventReasonFailed reports the rejected injection
+	EventReasonFailed = "VaultAgentInjectionFailed"
+	// EventReasonDegraded reports the pod admitted without injection in fail-open mode
+	EventReasonDegraded = "VaultAgentInjectionDegraded"
+)
+
+// EventNotifier emits Kubernetes Events on the pod owner, at most one per owner and reason within the interval
+type EventNotifier struct {
+	recorder record.EventRecorder
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// NewEventNotifier creates an EventNotifier emitting through the recorder
+func NewEventNotifier(recorder record.EventRecorder, interval time.Duration) *EventNotifier {
+	return &EventNotifier{
+		recorder: recorder,
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// allow applies the rate limit per owner and reason
+func (n *EventNotifier) allow(key string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := n.last[key]; ok && now.Sub(last) < n.interval {
+		return false
+	}
+	n.last[key] = now
+
+	// forget the owners not seen for a while
+	for k, t := range n.last {
+		if now.Sub(t) > 10*n.interval {
+			delete(n.last, k)
+		}
+	}
+	return true
+}
+
+// event emits the admission decision on the pod owner
+func (wk *WebHook) event(req *v1.AdmissionRequest, pod *corev1.Pod, response *v1.AdmissionResponse) {
+	n := wk.Events
+	if n == nil || response == nil || len(pod.OwnerReferences) == 0 {
+		return
+	}
+
+	owner := pod.OwnerReferences[0]
+	var eventType, reason, message string
+	switch auditOutcome(req, response) {
+	case "injected":
+		eventType, reason = corev1.EventTypeNormal, EventReasonInjected
+		message = fmt.Sprintf("Injected vault agent into pod %s, agent config in %s %s", pod.Name, wk.agentConfigKind(pod), agentConfigMapName(pod))
+	case "updated":
+		eventType, reason = corev1.EventTypeNormal, EventReasonUpdated
+		message = fmt.Sprintf("Regenerated vault agent %s %s for pod %s", wk.agentConfigKind(pod), agentConfigMapName(pod), pod.Name)
+	case "rejected":
+		eventType, reason = corev1.EventTypeWarning, EventReasonFailed
+		message = fmt.Sprintf("Vault agent injection rejected pod %s", pod.Name)
+		if response.Result != nil {
+			message = message + ": " + response.Result.Message
+		}
+	case "degraded":
+		eventType, reason = corev1.EventTypeWarning, EventReasonDegraded
+		message = fmt.Sprintf("Vault agent injection failed open for pod %s: %s", pod.Name, response.Result.Message)
+	default:
+		return
+	}
+
+	if !n.allow(pod.Namespace + "/" + owner.Kind + "/" + owner.Name + "/" + reason) {
+		return
+	}
+
+	n.recorder.Event(&corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Name:       owner.Name,
+		Namespace:  pod.Namespace,
+		UID:        owner.UID,
+	}, eventType, reason, message)
+}
+
+// agentConfigKind returns the kind of the agent config storage of the pod, the one recorded at injection time when injected
+func (wk *WebHook) agentConfigKind(pod *corev1.Pod) string {
+	storage := podConfigStorage(pod, wk.ConfigStorage)
+	if isInjected(pod) {
+		if details, err := GetInjectionDetails(*pod); err == nil {
+			storage = details.agentConfigStorage()
+		}
+	}
+	if storage == ConfigStorageSecret {
+		return "Secret"
+	}
+	return "ConfigMap"
+}
+
+// agentConfigMapName returns the name of the agent config map or secret generated for the pod
+func agentConfigMapName(pod *corev1.Pod) string {
+	if len(pod.OwnerReferences) == 0 {
+		return ""
+	}
+	name, err := GetDeploymentName(pod.OwnerReferences[0].Name)
+	if err != nil {
+		return ""
+	}
+	return VaultAgentConfigPrefix + "-" + name
+}
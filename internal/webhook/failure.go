@@ -0,0 +1,130 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// FailureModeClosed rejects the pod when the admission fails
+	FailureModeClosed = "closed"
+	// FailureModeOpen admits the pod without injection when the admission budget is exceeded or an API call fails,
+	// the validation and configuration errors are always rejected
+	FailureModeOpen = "open"
+
+	// InjectedLabelDegraded is the InjectedLabel value of the pods admitted without injection in fail-open mode
+	InjectedLabelDegraded = "degraded"
+
+	// NamespaceFailureModeAnnotation overrides the failure mode for the pods of the annotated namespace
+	NamespaceFailureModeAnnotation = AnnotationPrefix + "failure-mode"
+)
+
+// ValidateFailureMode verifies the failure mode is supported
+func ValidateFailureMode(mode string) error {
+	switch mode {
+	case FailureModeClosed, FailureModeOpen:
+		return nil
+	}
+	return fmt.Errorf("Unsupported failure mode %s, expected %s or %s", mode, FailureModeClosed, FailureModeOpen)
+}
+
+// failureMode returns the failure mode of the namespace, or the webhook one when the namespace does not override it
+func (wk *WebHook) failureMode(ctx context.Context, namespace string) string {
+	var ns *corev1.Namespace
+	var err error
+
+	if wk.Informers != nil {
+		ns, err = wk.Informers.Namespaces.Get(namespace)
+	}
+	if ns == nil {
+		ns, err = kube.GetNamespace(ctx, wk.Client, namespace)
+	}
+	if err != nil {
+		log.Warnf("Unable to read Namespace %s, using failure mode %s: %v", namespace, wk.FailureMode, err)
+		return wk.FailureMode
+	}
+
+	mode := strings.ToLower(ns.Annotations[NamespaceFailureModeAnnotation])
+	if mode == "" {
+		return wk.FailureMode
+	}
+	if err := ValidateFailureMode(mode); err != nil {
+		log.Warnf("Namespace %s annotation %s: %v, using failure mode %s", namespace, NamespaceFailureModeAnnotation, err, wk.FailureMode)
+		return wk.FailureMode
+	}
+	return mode
+}
+
+// checkBudget aborts the admission before the step when the budget is exceeded
+func checkBudget(ctx context.Context, step string) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("aborted before %s", step)
+	}
+	return nil
+}
+
+// transient reports the failures of the Kubernetes API calls worth admitting the pod without injection:
+// timeouts, throttling, server errors and connection failures
+func transient(err error) bool {
+	switch {
+	case errors.IsTimeout(err), errors.IsServerTimeout(err), errors.IsTooManyRequests(err),
+		errors.IsInternalError(err), errors.IsServiceUnavailable(err):
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// fail answers the failed admission, the pod is rejected or, in fail-open mode, admitted without injection
+// when the budget is exceeded or an API call failed. The degraded pods are annotated with the failure
+// and labelled to be found and restarted once the cause is fixed, the injected pods keep their label
+// and the agent config of the previous injection.
+func (wk *WebHook) fail(ctx context.Context, req *v1.AdmissionRequest, pod *corev1.Pod, mode string, err error) *v1.AdmissionResponse {
+	reason := "api"
+	if ctx.Err() != nil {
+		reason = "budget"
+		err = fmt.Errorf("Admission budget of %s exceeded: %v", wk.Budget, err)
+	} else if !transient(err) {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+
+	if mode != FailureModeOpen {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+
+	degradedAdmissions.WithLabelValues(pod.Namespace, reason).Inc()
+
+	patch := kube.UpdateAnnotation(pod.Annotations, map[string]string{annotationFailure.name: err.Error()})
+	if isInjected(pod) {
+		requestLogger(req, pod).WithField("error", err).Warnln("Admission failed open, injection not updated")
+	} else {
+		requestLogger(req, pod).WithField("error", err).Warnln("Admission failed open, pod admitted without injection")
+		patch = append(patch, kube.UpdateLabel(pod.Labels, map[string]string{InjectedLabel: InjectedLabelDegraded})...)
+	}
+	patches, perr := json.Marshal(patch)
+	if perr != nil {
+		return ToAdmissionResponseError(req.UID, perr)
+	}
+
+	return &v1.AdmissionResponse{
+		Allowed: true,
+		UID:     req.UID,
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
+		Patch: patches,
+		PatchType: func() *v1.PatchType {
+			pt := v1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestTransient(t *testing.T) {
+	configMaps := schema.GroupResource{Resource: "configmaps"}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", errors.NewTimeoutError("timeout", 1), true},
+		{"server timeout", errors.NewServerTimeout(configMaps, "create", 1), true},
+		{"too many requests", errors.NewTooManyRequests("throttled", 1), true},
+		{"internal error", errors.NewInternalError(errors.NewBadRequest("etcd")), true},
+		{"service unavailable", errors.NewServiceUnavailable("unavailable"), true},
+		{"connection", &net.OpError{Op: "dial", Err: &net.DNSError{IsTimeout: true}}, true},
+		{"forbidden", errors.NewForbidden(configMaps, "vault-agent-config-app", nil), false},
+		{"not found", errors.NewNotFound(configMaps, "vault-agent-config-app"), false},
+		{"conflict", errors.NewConflict(configMaps, "vault-agent-config-app", nil), false},
+		{"invalid", errors.NewInvalid(schema.GroupKind{Kind: "ConfigMap"}, "vault-agent-config-app", field.ErrorList{}), false},
+	}
+	for _, test := range tests {
+		if got := transient(test.err); got != test.want {
+			t.Errorf("%s: transient %v, expected %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFailOpenLabels(t *testing.T) {
+	wk := &WebHook{}
+	req := &v1.AdmissionRequest{UID: "uid", Operation: v1.Update}
+	unavailable := errors.NewServiceUnavailable("unavailable")
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "app"}}
+	response := wk.fail(context.Background(), req, pod, FailureModeOpen, unavailable)
+	if !response.Allowed || !strings.Contains(string(response.Patch), InjectedLabelDegraded) {
+		t.Errorf("pod not admitted in degraded mode: %+v, patch %s", response, response.Patch)
+	}
+
+	injected := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "app",
+		Namespace:   "app",
+		Annotations: map[string]string{annotationStatus.name: "injected"},
+		Labels:      map[string]string{InjectedLabel: "true"},
+	}}
+	response = wk.fail(context.Background(), req, injected, FailureModeOpen, unavailable)
+	if !response.Allowed {
+		t.Fatalf("injected pod rejected: %+v", response)
+	}
+	if strings.Contains(string(response.Patch), InjectedLabel) {
+		t.Errorf("injected pod relabelled: %s", response.Patch)
+	}
+	if !strings.Contains(string(response.Patch), strings.Replace(annotationFailure.name, "/", "~1", -1)) {
+		t.Errorf("injected pod not annotated with the failure: %s", response.Patch)
+	}
+}
+
+func TestAdmitOnlyInjectsOnCreate(t *testing.T) {
+	wk := &WebHook{SidecarConfig: &SidecarConfig{}}
+	pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:        "app",
+		Namespace:   "app",
+		Annotations: map[string]string{annotationPolicy.name: "true"},
+		Labels:      map[string]string{InjectedLabel: InjectedLabelDegraded},
+	}}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := wk.admit(context.Background(), v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		UID:       "uid",
+		Operation: v1.Update,
+		Namespace: "app",
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if !response.Allowed || len(response.Patch) != 0 {
+		t.Errorf("update of a degraded pod not let through: %+v, patch %s", response, response.Patch)
+	}
+}
+
+func TestRejectionUID(t *testing.T) {
+	wk := &WebHook{SidecarConfig: &SidecarConfig{}}
+	req := &v1.AdmissionRequest{UID: "uid", Operation: v1.Create, Namespace: "app"}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "app"}}
+
+	response := wk.fail(context.Background(), req, pod, FailureModeClosed, errors.NewServiceUnavailable("unavailable"))
+	if response.Allowed || response.UID != req.UID {
+		t.Errorf("fail-closed rejection: allowed %v, uid %q", response.Allowed, response.UID)
+	}
+
+	req.Object = runtime.RawExtension{Raw: []byte("{")}
+	response = wk.admit(context.Background(), v1.AdmissionReview{Request: req})
+	if response.Allowed || response.UID != req.UID {
+		t.Errorf("invalid pod rejection: allowed %v, uid %q", response.Allowed, response.UID)
+	}
+}
@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+)
+
+// funcMap returns the functions available to the sidecar templates,
+// annotation and label look up the values of the pod being injected
+func funcMap(data interface{}) template.FuncMap {
+	var annotations, labels map[string]string
+	requiredFunc := required
+	if sd, ok := data.(*SidecarData); ok && sd != nil {
+		annotations = sd.Annotations
+		labels = sd.Labels
+		if sd.sample {
+			requiredFunc = sampleRequired
+		}
+	}
+
+	return template.FuncMap{
+		"valueOrDefault": valueOrDefault,
+		"toJSON":         toJSON,
+		"toYaml":         toYaml,
+		"default":        defaultValue,
+		"required":       requiredFunc,
+		"upper":          strings.ToUpper,
+		"lower":          strings.ToLower,
+		"trim":           strings.TrimSpace,
+		"trimPrefix":     func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix":     func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":        func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"contains":       func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":      func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":      func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":          func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":           func(sep string, list []string) string { return strings.Join(list, sep) },
+		"quote":          strconv.Quote,
+		"squote":         func(s string) string { return "'" + strings.Replace(s, "'", "''", -1) + "'" },
+		"b64enc":         func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":         b64dec,
+		"indent":         indent,
+		"nindent":        func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+		"hclQuote":       hclQuote,
+		"annotation":     lookup(annotations),
+		"label":          lookup(labels),
+	}
+}
+
+func valueOrDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func toJSON(m map[string]string) string {
+	if m == nil {
+		return "{}"
+	}
+
+	ba, err := json.Marshal(m)
+	if err != nil {
+		log.Warnf("Unable to marshal %v", m)
+		return "{}"
+	}
+
+	return string(ba)
+}
+
+// toYaml renders a value as YAML without the trailing new line, to be used with indent/nindent
+func toYaml(value interface{}) (string, error) {
+	ba, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(ba), "\n"), nil
+}
+
+// defaultValue returns the given value unless it is empty, e.g. {{ .VaultRole | default "example" }}
+func defaultValue(def interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || isEmpty(given[0]) {
+		return def
+	}
+	return given[0]
+}
+
+// required fails the template execution with the message when the value is empty
+func required(message string, value interface{}) (interface{}, error) {
+	if isEmpty(value) {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+// sampleRequired replaces required in the load time render, the sample pod has none of the values
+// the template may require, a placeholder keeps the rendered sidecar valid
+func sampleRequired(message string, value interface{}) (interface{}, error) {
+	if isEmpty(value) {
+		return "sample", nil
+	}
+	return value, nil
+}
+
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func b64dec(s string) (string, error) {
+	ba, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(ba), nil
+}
+
+// indent prefixes every line with the given number of spaces
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+// hclQuote renders a string as a double quoted HCL literal. The agent reads its config with HCL1,
+// where ${ and %{ are literal text, escaping them as in HCL2 would corrupt the value.
+func hclQuote(s string) string {
+	replacer := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\t", `\t`,
+	)
+	return `"` + replacer.Replace(s) + `"`
+}
+
+// lookup returns a template function retrieving a key from the map or the optional default
+func lookup(m map[string]string) func(key string, def ...string) string {
+	return func(key string, def ...string) string {
+		if value, ok := m[key]; ok {
+			return value
+		}
+		if len(def) > 0 {
+			return def[0]
+		}
+		return ""
+	}
+}
@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"bytes"
+	"testing"
+	"text/template"
+)
+
+func TestFuncMap(t *testing.T) {
+	data := &SidecarData{
+		VaultRole:   "frontend",
+		Annotations: map[string]string{"example.com/team": "payments"},
+		Labels:      map[string]string{"app": "frontend"},
+		Container:   sampleSidecarData().Container,
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{"hclQuote", `{{ hclQuote "a \"b\" \\ c" }}`, `"a \"b\" \\ c"`, false},
+		{"hclQuote control characters", `{{ hclQuote "a\nb\tc\rd" }}`, `"a\nb\tc\rd"`, false},
+		{"hclQuote keeps HCL1 literals", `{{ hclQuote "a${b}c %{x}" }}`, `"a${b}c %{x}"`, false},
+		{"toYaml map", `{{ toYaml .Labels }}`, `app: frontend`, false},
+		{"toYaml list", `{{ toYaml (split "," "a,b") }}`, "- a\n- b", false},
+		{"toJSON", `{{ toJSON .Annotations }}`, `{"example.com/team":"payments"}`, false},
+		{"indent", `{{ indent 2 "a\nb" }}`, "  a\n  b", false},
+		{"nindent", `{{ toYaml .Labels | nindent 4 }}`, "\n    app: frontend", false},
+		{"default empty", `{{ "" | default "example" }}`, `example`, false},
+		{"default set", `{{ .VaultRole | default "example" }}`, `frontend`, false},
+		{"default missing", `{{ default "example" }}`, `example`, false},
+		{"valueOrDefault", `{{ valueOrDefault "" "example" }}`, `example`, false},
+		{"required set", `{{ required "role required" .VaultRole }}`, `frontend`, false},
+		{"required empty", `{{ required "secret required" .VaultSecret }}`, ``, true},
+		{"b64enc", `{{ b64enc "vault:agent" }}`, `dmF1bHQ6YWdlbnQ=`, false},
+		{"b64dec", `{{ b64dec "dmF1bHQ6YWdlbnQ=" }}`, `vault:agent`, false},
+		{"b64dec invalid", `{{ b64dec "%%%" }}`, ``, true},
+		{"quote", `{{ quote "a \"b\"" }}`, `"a \"b\""`, false},
+		{"squote", `{{ squote "it's" }}`, `'it''s'`, false},
+		{"annotation", `{{ annotation "example.com/team" }}`, `payments`, false},
+		{"annotation default", `{{ annotation "example.com/missing" "none" }}`, `none`, false},
+		{"label", `{{ label "app" }}`, `frontend`, false},
+		{"strings", `{{ upper "a" }}{{ lower "B" }}{{ trim " c " }}{{ trimPrefix "x-" "x-d" }}{{ replace "-" "." "e-f" }}`, `Abcde.f`, false},
+		{"join", `{{ join "," (split ":" "a:b") }}`, `a,b`, false},
+	}
+
+	for _, test := range tests {
+		tmpl, err := template.New(test.name).Funcs(funcMap(data)).Parse(test.template)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var out bytes.Buffer
+		err = tmpl.Execute(&out, data)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error, rendered %q", test.name, out.String())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: rendered %q, expected %q", test.name, out.String(), test.want)
+		}
+	}
+}
+
+func TestToJSONNil(t *testing.T) {
+	if out := toJSON(nil); out != "{}" {
+		t.Errorf("toJSON(nil) rendered %q, expected {}", out)
+	}
+}
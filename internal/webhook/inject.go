@@ -2,48 +2,84 @@ package webhook
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"text/template"
 
-	"github.com/ghodss/yaml"
+	"github.com/openlab-red/mutating-webhook-vault-agent/internal/tracing"
 	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/kv"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/util/retry"
 )
 
 const (
 	// VaultAgentConfigPrefix represents a prefix for the config map
 	VaultAgentConfigPrefix = "vault-agent-config"
+	// CABundleConfigMapName represents the name of the CA bundle config map in the application namespace
+	CABundleConfigMapName = "vault-agent-cabundle"
+	// CABundleKey represents the key of the CA bundle in the config map
+	CABundleKey = "service-ca.crt"
+
+	// CABundleSourceOpenShift injects the service CA with the OpenShift service-ca operator
+	CABundleSourceOpenShift = "openshift"
+	// CABundleSourceSecret copies the CA from a Secret in the webhook namespace
+	CABundleSourceSecret = "secret"
+	// CABundleSourceConfigMap copies the CA from a ConfigMap in the webhook namespace
+	CABundleSourceConfigMap = "configmap"
+	// CABundleSourceEmbedded copies the CA embedded in the sidecar config
+	CABundleSourceEmbedded = "embedded"
+
+	// injectCABundleAnnotation asks the OpenShift service-ca operator to write the service CA into the ConfigMap
+	injectCABundleAnnotation = "service.beta.openshift.io/inject-cabundle"
+
+	// DataHashAnnotation records the sha256 of the data written by the webhook into the ConfigMap or the Secret
+	DataHashAnnotation = "vault-agent.vaultproject.io/data-hash"
+
+	// DefaultMountPath represents the default mount path of the secrets in the application container
+	DefaultMountPath = "/var/run/secrets/vaultproject.io"
+
+	// DefaultVaultRole represents the Vault role used when the pod does not annotate one
+	DefaultVaultRole = "example"
+
+	templateInject        = "template"
+	templateAgentConfig   = "agent.config"
+	templateAgentTemplate = "template.ctmpl"
 )
 
-func inject(data *SidecarData, config *SidecarConfig) (*SidecarInject, error) {
+func inject(ctx context.Context, data *SidecarData, config *SidecarConfig) (*SidecarInject, error) {
 
 	sic := SidecarInject{}
 
-	tmpl, err := executeTemplate(config.Template, data)
+	tmpl, err := executeTemplate(ctx, config.templates[templateInject], data)
 	if err != nil {
 		return nil, err
 	}
 
-	err = unmarshalTemplate(tmpl, &sic)
+	err = unmarshalTemplate(tmpl, &sic, field.NewPath(templateInject))
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: seems not working the inject to volumeMounts
-	var volumeMounts []corev1.VolumeMount
-	volumeMount := FindVolumeMount(sic.Containers[0].VolumeMounts, "vault-agent-volume")
-	volumeMounts = append(volumeMounts, volumeMount)
-	sic.VolumeMount = volumeMounts
-	//
+	if errs := validateSidecarInject(&sic, field.NewPath(templateInject)); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+
+	if err := applyResources(&sic, data.Resources); err != nil {
+		return nil, err
+	}
 
-	log.Debugln("SidecarInject: ", sic)
 	return &sic, nil
 }
 
-func isRequired(ignored []string, pod *corev1.Pod) bool {
+func isRequired(ignored []string, pod *corev1.Pod, reqLog *logrus.Entry) bool {
 	var status, inject string
 	required := false
 	metadata := pod.ObjectMeta
@@ -56,17 +92,14 @@ func isRequired(ignored []string, pod *corev1.Pod) bool {
 	}
 
 	annotations := metadata.GetAnnotations()
-	log.Debugf("Annotations: %v", annotations)
 
 	if annotations != nil {
 		status = annotations[annotationStatus.name]
 
-		log.Debugln(status)
 		if strings.ToLower(status) == "injected" {
 			required = false
 		} else {
 			inject = annotations[annotationPolicy.name]
-			log.Debugln(inject)
 			switch strings.ToLower(inject) {
 			default:
 				required = false
@@ -76,125 +109,317 @@ func isRequired(ignored []string, pod *corev1.Pod) bool {
 		}
 	}
 
-	log.WithFields(logrus.Fields{
-		"name":      metadata.Name,
-		"namespace": metadata.Namespace,
-		"status":    status,
-		"inject":    inject,
-		"required":  required,
+	reqLog.WithFields(logrus.Fields{
+		"status":   status,
+		"inject":   inject,
+		"required": required,
 	}).Infoln("Mutation policy")
 
 	return required
 }
 
-func agentConfigMap(prefix string, pod corev1.Pod, wk *WebHook, sidecarData *SidecarData, init bool) (*corev1.ConfigMap, error) {
-	client := kube.Client()
-	configMaps := client.CoreV1().ConfigMaps(pod.Namespace)
+func isInjected(pod *corev1.Pod) bool {
+	status := GetAnnotationValue(*pod, annotationStatus, "")
+	return strings.ToLower(status) == "injected"
+}
 
+func hasContainer(pod *corev1.Pod, name string) bool {
+	for _, c := range pod.Spec.InitContainers {
+		if c.Name == name {
+			return true
+		}
+	}
+	for _, c := range pod.Spec.Containers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// agentConfig renders the agent config into the ConfigMap or the Secret selected by the sidecar data, returning its name
+func agentConfig(ctx context.Context, prefix string, pod corev1.Pod, wk *WebHook, sidecarData *SidecarData, init bool) (name string, err error) {
 	data := make(map[string]string)
-	name := prefix + "-" + sidecarData.Name
+	name = prefix + "-" + sidecarData.Name
 	sidecarData.VaultInit = init
 
-	tmpl, err := executeTemplate(wk.SidecarConfig.VaultAgentConfig, sidecarData)
+	ctx, span := tracing.Start(ctx, "agentConfig", kv.String("namespace", pod.Namespace), kv.String("name", name), kv.String("storage", sidecarData.ConfigStorage))
+	defer func() { tracing.End(ctx, span, err) }()
+
+	tmpl, err := executeTemplate(ctx, wk.SidecarConfig.templates[templateAgentConfig], sidecarData)
 
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	data["agent.config"] = string(tmpl.Bytes())
 
-	tmpl, err = executeTemplate(wk.SidecarConfig.VaultAgentTemplate, sidecarData)
+	tmpl, err = executeTemplate(ctx, wk.SidecarConfig.templates[templateAgentTemplate], sidecarData)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	data["template.ctmpl"] = string(tmpl.Bytes())
-	currentConfigMap, err := configMaps.Get(name, metav1.GetOptions{})
 
-	if err != nil {
-		annotations := make(map[string]string)
-		annotations["vault-agent.vaultproject.io"] = "generated"
+	hash := dataHash(data)
+	meta := metav1.ObjectMeta{
+		Name:      name,
+		Namespace: pod.Namespace,
+		Annotations: map[string]string{
+			"vault-agent.vaultproject.io": "generated",
+			DataHashAnnotation:            hash,
+		},
+		Labels: managedLabels(),
+	}
+
+	if sidecarData.ConfigStorage == ConfigStorageSecret {
+		_, err = wk.createOrUpdateSecret(ctx, &corev1.Secret{
+			ObjectMeta: meta,
+			Type:       corev1.SecretTypeOpaque,
+			Data:       secretData(data),
+		}, hash)
+		return name, err
+	}
 
-		configMap := corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:        name,
-				Namespace:   pod.Namespace,
-				Annotations: annotations,
-			},
-			Data: data,
+	_, err = wk.createOrUpdateConfigMap(ctx, &corev1.ConfigMap{
+		ObjectMeta: meta,
+		Data:       data,
+	}, func(current *corev1.ConfigMap) bool {
+		// the data is hashed as well, the annotation is kept when the ConfigMap is edited
+		if current.Annotations[DataHashAnnotation] == hash && dataHash(current.Data) == hash && isManaged(&current.ObjectMeta) {
+			return false
 		}
-		return configMaps.Create(&configMap)
+		current.Data = data
+		setDataHash(&current.ObjectMeta, hash)
+		setManagedLabel(&current.ObjectMeta)
+		return true
+	})
+	return name, err
+}
+
+func caBundleConfigMap(ctx context.Context, pod corev1.Pod, wk *WebHook, sidecarData *SidecarData) (configMap *corev1.ConfigMap, err error) {
+	ctx, span := tracing.Start(ctx, "caBundleConfigMap", kv.String("namespace", pod.Namespace), kv.String("source", wk.CABundle.Source))
+	defer func() { tracing.End(ctx, span, err) }()
+
+	annotations := make(map[string]string)
+	var data map[string]string
+	if wk.CABundle.Source == CABundleSourceOpenShift {
+		annotations[injectCABundleAnnotation] = "true"
+	} else {
+		caBundle, err := wk.caBundle(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data = map[string]string{CABundleKey: caBundle}
+		annotations[DataHashAnnotation] = dataHash(data)
+	}
+
+	desired := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        CABundleConfigMapName,
+			Namespace:   pod.Namespace,
+			Annotations: annotations,
+			Labels:      managedLabels(),
+		},
+		Data: data,
 	}
-	currentConfigMap.Data = data
-	return configMaps.Update(currentConfigMap)
+	// keep the namespace copy up to date with the source, and labelled to be cached
+	return wk.createOrUpdateConfigMap(ctx, desired, func(current *corev1.ConfigMap) bool {
+		hash := annotations[DataHashAnnotation]
+		// the OpenShift service CA operator writes the data, only the copies are hashed
+		unchanged := data == nil || (current.Annotations[DataHashAnnotation] == hash && dataHash(current.Data) == hash)
+		// a copy left annotated by a previous openshift source would be overwritten by the service CA operator
+		_, injected := current.Annotations[injectCABundleAnnotation]
+		if data != nil && injected {
+			unchanged = false
+		}
+		if unchanged && isManaged(&current.ObjectMeta) {
+			return false
+		}
+		if data != nil {
+			current.Data = data
+			delete(current.Annotations, injectCABundleAnnotation)
+			setDataHash(&current.ObjectMeta, hash)
+		}
+		setManagedLabel(&current.ObjectMeta)
+		return true
+	})
 }
 
-func caBundleConfigMap(pod corev1.Pod, wk *WebHook, sidecarData *SidecarData) (*corev1.ConfigMap, error) {
-	client := kube.Client()
-	configMaps := client.CoreV1().ConfigMaps(pod.Namespace)
+// createOrUpdateConfigMap creates the desired ConfigMap or applies update to the current one. update reports
+// whether the ConfigMap changed, the unchanged ConfigMaps are not written. The replicas admitting the pods
+// of the same owner race on the ConfigMap, the conflicts are retried reading the ConfigMap from the API server.
+func (wk *WebHook) createOrUpdateConfigMap(ctx context.Context, desired *corev1.ConfigMap, update func(current *corev1.ConfigMap) bool) (*corev1.ConfigMap, error) {
+	var result *corev1.ConfigMap
+
+	err := retryWrite(ctx, func(fresh bool) error {
+		var current *corev1.ConfigMap
+		var err error
+		if !fresh {
+			current, err = wk.getConfigMap(ctx, desired.Namespace, desired.Name)
+		} else {
+			log.Debugf("Retrying write of ConfigMap %s/%s", desired.Namespace, desired.Name)
+			current, err = kube.GetConfigMap(ctx, wk.Client, desired.Namespace, desired.Name)
+		}
 
-	currentConfigMap, err := configMaps.Get("vault-agent-cabundle", metav1.GetOptions{})
+		switch {
+		case errors.IsNotFound(err):
+			result, err = kube.CreateConfigMap(ctx, wk.Client, desired)
+		case err != nil:
+		case update(current):
+			result, err = kube.UpdateConfigMap(ctx, wk.Client, current)
+		default:
+			log.Debugf("ConfigMap %s/%s unchanged, write skipped", desired.Namespace, desired.Name)
+			result = current
+		}
+		return err
+	})
 	if err != nil {
-		annotations := make(map[string]string)
-		annotations["service.beta.openshift.io/inject-cabundle"] = "true"
+		return nil, err
+	}
+	return result, nil
+}
 
-		configMap := corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:        "vault-agent-cabundle",
-				Namespace:   pod.Namespace,
-				Annotations: annotations,
-			},
+// retryWrite runs write until it does not conflict with the other replicas writing the same object,
+// fresh is set on the retries to read the object from the API server rather than from the cache
+func retryWrite(ctx context.Context, write func(fresh bool) error) error {
+	attempt := 0
+	return retry.OnError(retry.DefaultBackoff, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		attempt++
+		return write(attempt > 1)
+	})
+}
+
+// getConfigMap reads a ConfigMap from the informer cache, falling back to the API server
+// for the ConfigMaps not cached yet or created without the managed-by label
+func (wk *WebHook) getConfigMap(ctx context.Context, namespace, name string) (*corev1.ConfigMap, error) {
+	if wk.Informers != nil {
+		configMap, err := wk.Informers.ConfigMaps.ConfigMaps(namespace).Get(name)
+		if err == nil {
+			// the cached objects are shared and must not be modified
+			return configMap.DeepCopy(), nil
 		}
-		return configMaps.Create(&configMap)
 	}
-	return currentConfigMap, err
+	return kube.GetConfigMap(ctx, wk.Client, namespace, name)
 }
 
-func executeTemplate(source string, data interface{}) (*bytes.Buffer, error) {
-	var tmpl bytes.Buffer
+func managedLabels() map[string]string {
+	return map[string]string{kube.ManagedByLabel: kube.ManagedByValue}
+}
 
-	funcMap := template.FuncMap{
-		"valueOrDefault": valueOrDefault,
-		"toJSON":         toJSON,
-	}
+func isManaged(meta *metav1.ObjectMeta) bool {
+	return meta.Labels[kube.ManagedByLabel] == kube.ManagedByValue
+}
 
-	temp := template.New("inject")
-	t := template.Must(temp.Funcs(funcMap).Parse(source))
+// dataHash returns the sha256 of the rendered data, json.Marshal sorts the keys
+func dataHash(data map[string]string) string {
+	ba, _ := json.Marshal(data)
+	return fmt.Sprintf("%x", sha256.Sum256(ba))
+}
 
-	if err := t.Execute(&tmpl, &data); err != nil {
-		log.Errorf("Failed to execute template %v %s", err, source)
-		return nil, err
+func setDataHash(meta *metav1.ObjectMeta, hash string) {
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
 	}
+	meta.Annotations[DataHashAnnotation] = hash
+}
 
-	return &tmpl, nil
+// setManagedLabel labels the ConfigMaps created by the previous versions, to be cached by the informer
+func setManagedLabel(meta *metav1.ObjectMeta) {
+	if meta.Labels == nil {
+		meta.Labels = make(map[string]string)
+	}
+	meta.Labels[kube.ManagedByLabel] = kube.ManagedByValue
 }
 
-func unmarshalTemplate(tmpl *bytes.Buffer, target interface{}) error {
-	log.Debugf("Template executed, %s", string(tmpl.Bytes()))
+// caBundle returns the PEM CA bundle from the configured source
+func (wk *WebHook) caBundle(ctx context.Context) (string, error) {
+	var caBundle string
 
-	if err := yaml.Unmarshal(tmpl.Bytes(), &target); err != nil {
-		log.Errorf("Failed to unmarshal template %v %s", err, string(tmpl.Bytes()))
-		return err
+	switch wk.CABundle.Source {
+	case CABundleSourceSecret:
+		secret, err := kube.GetSecret(ctx, wk.Client, wk.CABundle.Namespace, wk.CABundle.Name)
+		if err != nil {
+			return "", err
+		}
+		caBundle = string(secret.Data[wk.CABundle.Key])
+	case CABundleSourceConfigMap:
+		configMap, err := kube.GetConfigMap(ctx, wk.Client, wk.CABundle.Namespace, wk.CABundle.Name)
+		if err != nil {
+			return "", err
+		}
+		caBundle = configMap.Data[wk.CABundle.Key]
+	case CABundleSourceEmbedded:
+		caBundle = wk.SidecarConfig.CABundle
+	default:
+		return "", fmt.Errorf("Unsupported CA bundle source %s", wk.CABundle.Source)
 	}
 
-	return nil
+	if strings.TrimSpace(caBundle) == "" {
+		return "", fmt.Errorf("Empty CA bundle from %s source %s/%s key %s", wk.CABundle.Source, wk.CABundle.Namespace, wk.CABundle.Name, wk.CABundle.Key)
+	}
+	return caBundle, nil
 }
 
-func valueOrDefault(value string, defaultValue string) string {
-	if value == "" {
-		return defaultValue
+// parseTemplates parses the sidecar config templates once, to be executed for every admission
+func parseTemplates(config *SidecarConfig) error {
+	sources := map[string]string{
+		templateInject:        config.Template,
+		templateAgentConfig:   config.VaultAgentConfig,
+		templateAgentTemplate: config.VaultAgentTemplate,
+	}
+
+	templates := make(map[string]*template.Template)
+	for name, source := range sources {
+		t, err := template.New(name).Funcs(funcMap(nil)).Option("missingkey=error").Parse(source)
+		if err != nil {
+			return fmt.Errorf("Failed to parse %s: %v", name, err)
+		}
+		templates[name] = t
 	}
-	return value
+	config.templates = templates
+
+	return nil
 }
 
-func toJSON(m map[string]string) string {
-	if m == nil {
-		return "{}"
+func executeTemplate(ctx context.Context, t *template.Template, data interface{}) (buffer *bytes.Buffer, err error) {
+	var tmpl bytes.Buffer
+
+	if t == nil {
+		return nil, fmt.Errorf("Sidecar config templates not loaded")
 	}
 
-	ba, err := json.Marshal(m)
+	ctx, span := tracing.Start(ctx, "executeTemplate", kv.String("template", t.Name()))
+	defer func() { tracing.End(ctx, span, err) }()
+
+	// clone to bind the pod specific functions without affecting concurrent executions
+	clone, err := t.Clone()
 	if err != nil {
-		log.Warnf("Unable to marshal %v", m)
-		return "{}"
+		return nil, err
+	}
+
+	// the sample pod rendered at load time has no annotations nor labels, missing keys render empty
+	if sd, ok := data.(*SidecarData); ok && sd != nil && sd.sample {
+		clone.Option("missingkey=zero")
+	}
+
+	if err := clone.Funcs(funcMap(data)).Execute(&tmpl, &data); err != nil {
+		log.Errorf("Failed to execute template %s: %v", t.Name(), err)
+		return nil, err
 	}
 
-	return string(ba)
+	return &tmpl, nil
+}
+
+func unmarshalTemplate(tmpl *bytes.Buffer, target interface{}, fldPath *field.Path) error {
+	// the rendered template is not logged, it may hold secrets
+	if err := strictUnmarshal(tmpl.Bytes(), target, fldPath); err != nil {
+		log.Errorf("Failed to unmarshal template %v", err)
+		return err
+	}
+
+	return nil
 }
@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// loadShippedConfig loads the sidecar config of build/sidecar-configmap.yaml the way it is mounted in the webhook pod
+func loadShippedConfig(t *testing.T) *SidecarConfig {
+	t.Helper()
+
+	manifest, err := ioutil.ReadFile(filepath.Join("..", "..", "build", "sidecar-configmap.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMap := corev1.ConfigMap{}
+	if err := yaml.Unmarshal(bytes.Split(manifest, []byte("\n---\n"))[0], &configMap); err != nil {
+		t.Fatal(err)
+	}
+	data, ok := configMap.Data["sidecarconfig.yaml"]
+	if !ok {
+		t.Fatalf("ConfigMap %s has no sidecarconfig.yaml", configMap.Name)
+	}
+
+	dir, err := ioutil.TempDir("", "sidecarconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sidecarconfig.yaml")
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &SidecarConfig{}
+	if err := Load(file, config); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return config
+}
+
+func TestInjectShippedConfig(t *testing.T) {
+	config := loadShippedConfig(t)
+	if config.Hash == "" {
+		t.Error("Load did not record the config hash")
+	}
+
+	data := &SidecarData{
+		Name: "frontend",
+		Container: corev1.Container{
+			Name:  "frontend",
+			Image: "quay.io/example/frontend:1.0",
+		},
+		TokenVolume:   "default-token-abcde",
+		VaultSecret:   "secret/frontend",
+		VaultFileName: "application.yaml",
+		VaultRole:     "frontend",
+		MountPath:     "/etc/frontend/secrets",
+		ConfigStorage: ConfigStorageConfigMap,
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+		},
+		Annotations: map[string]string{},
+		Labels:      map[string]string{"app": "frontend"},
+	}
+
+	sic, err := inject(context.Background(), data, config)
+	if err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+
+	if names := containerNames(sic.InitContainers); len(names) != 1 || names[0] != "vault-agent-init" {
+		t.Errorf("init containers %v, expected [vault-agent-init]", names)
+	}
+	if names := containerNames(sic.Containers); len(names) != 1 || names[0] != "vault-agent" {
+		t.Errorf("containers %v, expected [vault-agent]", names)
+	}
+	for _, container := range append(sic.InitContainers, sic.Containers...) {
+		if container.Image == "" {
+			t.Errorf("container %s has no image", container.Name)
+		}
+		if limit := container.Resources.Limits[corev1.ResourceMemory]; limit.String() != "512Mi" {
+			t.Errorf("container %s memory limit %s, expected the annotation 512Mi", container.Name, limit.String())
+		}
+	}
+
+	volumes := map[string]corev1.Volume{}
+	for _, volume := range sic.Volumes {
+		volumes[volume.Name] = volume
+	}
+	if volume, ok := volumes["vault-agent-volume"]; !ok || volume.EmptyDir == nil {
+		t.Errorf("vault-agent-volume missing or not an emptyDir: %+v", volume)
+	}
+	if volume, ok := volumes["vault-config"]; !ok || volume.ConfigMap == nil || volume.ConfigMap.Name != VaultAgentConfigPrefix+"-frontend" {
+		t.Errorf("vault-config does not reference the %s-frontend ConfigMap: %+v", VaultAgentConfigPrefix, volume)
+	}
+	if _, ok := volumes["vault-cabundle"]; !ok {
+		t.Error("vault-cabundle volume missing")
+	}
+
+	if len(sic.VolumeMount) != 1 {
+		t.Fatalf("application volume mounts %+v, expected one", sic.VolumeMount)
+	}
+	if mount := sic.VolumeMount[0]; mount.Name != "vault-agent-volume" || mount.MountPath != data.MountPath || !mount.ReadOnly {
+		t.Errorf("application volume mount %+v, expected vault-agent-volume read only on %s", mount, data.MountPath)
+	}
+}
+
+func containerNames(containers []corev1.Container) []string {
+	var names []string
+	for _, container := range containers {
+		names = append(names, container.Name)
+	}
+	return names
+}
+
+func TestLoadTemplateUsingPodValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecarconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sidecarconfig.yaml")
+	source := `template: |-
+  containers:
+  - name: vault-agent
+    image: {{ required "the agent image annotation is required" (annotation "example.com/agent-image") }}
+    args:
+    - -role={{ .Annotations.role }}
+    - -team={{ label "team" }}
+  volumes:
+  - name: vault-agent-volume
+    emptyDir: {}
+agent.config: ""
+template.ctmpl: ""
+`
+	if err := ioutil.WriteFile(file, []byte(source), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &SidecarConfig{}
+	if err := Load(file, config); err != nil {
+		t.Fatalf("Load rejected a template using the pod annotations and labels: %v", err)
+	}
+
+	data := sampleSidecarData()
+	data.sample = false
+	if _, err := inject(context.Background(), data, config); err == nil {
+		t.Error("inject succeeded without the required annotation")
+	}
+
+	data.Annotations = map[string]string{"example.com/agent-image": "vault:1.3.2", "role": "frontend"}
+	sic, err := inject(context.Background(), data, config)
+	if err != nil {
+		t.Fatalf("inject: %v", err)
+	}
+	if image := sic.Containers[0].Image; image != "vault:1.3.2" {
+		t.Errorf("image %s, expected the annotation vault:1.3.2", image)
+	}
+}
+
+func TestLoadInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecarconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "sidecarconfig.yaml")
+	source := `template: |-
+  containers:
+  - name: vault-agent
+    image: vault:1.3.2
+    securityContext:
+      RunAsUser: 1000
+agent.config: ""
+template.ctmpl: ""
+`
+	if err := ioutil.WriteFile(file, []byte(source), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &SidecarConfig{}
+	if err := Load(file, config); err == nil {
+		t.Fatal("Load accepted a template with an unknown field")
+	}
+	if err := config.Check(); err == nil {
+		t.Error("Check reports a broken config as loaded")
+	}
+	if config.templates != nil || config.Hash != "" {
+		t.Errorf("the broken config has been applied, hash %q", config.Hash)
+	}
+}
@@ -0,0 +1,16 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	degradedAdmissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vault_agent_webhook_degraded_admissions_total",
+		Help: "Pods admitted without injection in fail-open mode, by namespace and reason",
+	}, []string{"namespace", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(degradedAdmissions)
+}
@@ -0,0 +1,106 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const redacted = "<redacted>"
+
+// Redactor strips the sensitive values of a pod before logging it
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor creates a Redactor stripping the annotation values matching one of the patterns
+func NewRedactor(patterns []string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redaction pattern %s: %v", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Pod returns a copy of the pod without container env values and sensitive annotation values
+func (r *Redactor) Pod(pod *corev1.Pod) *corev1.Pod {
+	redactedPod := pod.DeepCopy()
+	redactEnv(redactedPod.Spec.InitContainers)
+	redactEnv(redactedPod.Spec.Containers)
+	for key, value := range redactedPod.Annotations {
+		if r.matches(value) {
+			redactedPod.Annotations[key] = redacted
+		}
+	}
+	return redactedPod
+}
+
+// JSON returns the JSON document, e.g. a rendered sidecar or a patch, without env values and sensitive string values
+func (r *Redactor) JSON(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return redacted
+	}
+	ba, err := json.Marshal(r.redactValue(document))
+	if err != nil {
+		return redacted
+	}
+	return string(ba)
+}
+
+func (r *Redactor) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if env, ok := item.([]interface{}); ok && key == "env" {
+				for _, variable := range env {
+					if variable, ok := variable.(map[string]interface{}); ok && variable["value"] != nil {
+						variable["value"] = redacted
+					}
+				}
+				continue
+			}
+			v[key] = r.redactValue(item)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = r.redactValue(v[i])
+		}
+	case string:
+		if r.matches(v) {
+			return redacted
+		}
+	}
+	return value
+}
+
+func (r *Redactor) matches(value string) bool {
+	if r == nil {
+		return false
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactEnv(containers []corev1.Container) {
+	for i := range containers {
+		for j := range containers[i].Env {
+			if containers[i].Env[j].Value != "" {
+				containers[i].Env[j].Value = redacted
+			}
+		}
+	}
+}
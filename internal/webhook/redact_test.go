@@ -0,0 +1,31 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactorJSON(t *testing.T) {
+	redactor, err := NewRedactor([]string{`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patch := `[{"op":"add","path":"/spec/containers/-","value":{"name":"vault-agent","env":[{"name":"VAULT_TOKEN","value":"s.abcdef"},{"name":"FROM_SECRET","valueFrom":{"secretKeyRef":{"name":"vault","key":"token"}}}]}},` +
+		`{"op":"add","path":"/metadata/annotations/jwt","value":"eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0"}]`
+
+	out := redactor.JSON([]byte(patch))
+	for _, secret := range []string{"s.abcdef", "eyJhbGciOiJIUzI1NiJ9"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%s not redacted: %s", secret, out)
+		}
+	}
+	for _, kept := range []string{"vault-agent", "VAULT_TOKEN", "secretKeyRef", "/spec/containers/-"} {
+		if !strings.Contains(out, kept) {
+			t.Errorf("%s missing: %s", kept, out)
+		}
+	}
+	if redactor.JSON(nil) != "" {
+		t.Error("empty patch not logged empty")
+	}
+}
@@ -0,0 +1,139 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Registration defines the MutatingWebhookConfiguration managed by the webhook
+type Registration struct {
+	Name              string
+	WebhookName       string
+	ServiceName       string
+	ServiceNamespace  string
+	ServicePath       string
+	ServicePort       int32
+	FailurePolicy     string
+	TimeoutSeconds    int32
+	NamespaceSelector string
+	Operations        []string
+}
+
+// MutatingWebhookConfiguration returns the desired configuration trusting the caBundle
+func (r *Registration) MutatingWebhookConfiguration(caBundle []byte) (*admissionregistrationv1.MutatingWebhookConfiguration, error) {
+	selector, err := metav1.ParseToLabelSelector(r.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid namespace selector %s: %v", r.NamespaceSelector, err)
+	}
+
+	failurePolicy := admissionregistrationv1.FailurePolicyType(r.FailurePolicy)
+	if failurePolicy != admissionregistrationv1.Fail && failurePolicy != admissionregistrationv1.Ignore {
+		return nil, fmt.Errorf("Invalid failure policy %s, expected Fail or Ignore", r.FailurePolicy)
+	}
+
+	var operations []admissionregistrationv1.OperationType
+	for _, op := range r.Operations {
+		operations = append(operations, admissionregistrationv1.OperationType(strings.ToUpper(strings.TrimSpace(op))))
+	}
+
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	path := r.ServicePath
+	port := r.ServicePort
+	timeout := r.TimeoutSeconds
+
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admissionregistration.k8s.io/v1",
+			Kind:       "MutatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: r.Name,
+			Labels: map[string]string{
+				"app.kubernetes.io/instance": r.ServiceName,
+				"app.kubernetes.io/name":     r.ServiceName,
+			},
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name:                    r.WebhookName,
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+				TimeoutSeconds:          &timeout,
+				FailurePolicy:           &failurePolicy,
+				NamespaceSelector:       selector,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{
+						Name:      r.ServiceName,
+						Namespace: r.ServiceNamespace,
+						Path:      &path,
+						Port:      &port,
+					},
+					CABundle: caBundle,
+				},
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: operations,
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods"},
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// Register creates or patches the MutatingWebhookConfiguration with the caBundle
+func (r *Registration) Register(caBundle []byte) error {
+	if len(caBundle) == 0 {
+		return fmt.Errorf("Empty CA bundle, unable to register %s", r.Name)
+	}
+
+	desired, err := r.MutatingWebhookConfiguration(caBundle)
+	if err != nil {
+		return err
+	}
+
+	client, err := kube.NewClient()
+	if err != nil {
+		return err
+	}
+	configurations := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+
+	_, err = configurations.Get(r.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if _, err = configurations.Create(desired); err != nil {
+			return err
+		}
+		log.Infof("MutatingWebhookConfiguration %s created", r.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the webhooks are merged by name, other webhooks of the configuration are kept
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": desired.Labels,
+		},
+		"webhooks": desired.Webhooks,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = configurations.Patch(r.Name, types.StrategicMergePatchType, patch); err != nil {
+		return err
+	}
+	log.Infof("MutatingWebhookConfiguration %s patched", r.Name)
+	return nil
+}
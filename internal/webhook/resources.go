@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/internal/tracing"
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/kv"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+)
+
+// applyResources overrides the template resources of every injected container
+func applyResources(sic *SidecarInject, resources corev1.ResourceRequirements) error {
+	for i := range sic.InitContainers {
+		if err := mergeResources(&sic.InitContainers[i], resources); err != nil {
+			return err
+		}
+	}
+	for i := range sic.Containers {
+		if err := mergeResources(&sic.Containers[i], resources); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergeResources(container *corev1.Container, resources corev1.ResourceRequirements) error {
+	for name, quantity := range resources.Requests {
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		container.Resources.Requests[name] = quantity
+	}
+	for name, quantity := range resources.Limits {
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = corev1.ResourceList{}
+		}
+		container.Resources.Limits[name] = quantity
+	}
+	// the annotations and the template disagree, the pod would be rejected by the API server
+	for name, request := range container.Resources.Requests {
+		if limit, ok := container.Resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("Container %s %s request %s exceeds limit %s, set both the agent request and limit annotations", container.Name, name, request.String(), limit.String())
+		}
+	}
+	return nil
+}
+
+// namespaceLimitRanges returns the Container LimitRange items of a namespace
+func namespaceLimitRanges(ctx context.Context, client kubernetes.Interface, namespace string) []corev1.LimitRangeItem {
+	var items []corev1.LimitRangeItem
+
+	ctx, span := tracing.Start(ctx, "namespaceLimitRanges", kv.String("namespace", namespace))
+	defer span.End()
+
+	limitRanges, err := kube.ListLimitRanges(ctx, client, namespace)
+	if err != nil {
+		log.Warnf("Unable to list LimitRanges in %s: %v", namespace, err)
+		span.RecordError(ctx, err)
+		return items
+	}
+
+	for _, limitRange := range limitRanges.Items {
+		for _, item := range limitRange.Spec.Limits {
+			if item.Type == corev1.LimitTypeContainer {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// fitLimitRanges adjusts the injected containers resources to the namespace LimitRange constraints
+func fitLimitRanges(sic *SidecarInject, items []corev1.LimitRangeItem) error {
+	for _, item := range items {
+		for i := range sic.InitContainers {
+			if err := fitLimitRange(&sic.InitContainers[i], item); err != nil {
+				return err
+			}
+		}
+		for i := range sic.Containers {
+			if err := fitLimitRange(&sic.Containers[i], item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func fitLimitRange(container *corev1.Container, item corev1.LimitRangeItem) error {
+	resources := &container.Resources
+	if resources.Requests == nil {
+		resources.Requests = corev1.ResourceList{}
+	}
+	if resources.Limits == nil {
+		resources.Limits = corev1.ResourceList{}
+	}
+
+	adjust := func(list corev1.ResourceList, kind string, name corev1.ResourceName, quantity resource.Quantity) {
+		log.WithFields(logrus.Fields{
+			"container": container.Name,
+			"resource":  name,
+			"from":      list[name],
+			"to":        quantity.String(),
+		}).Warnf("Adjusting %s to the namespace LimitRange", kind)
+		list[name] = quantity.DeepCopy()
+	}
+
+	for name, max := range item.Max {
+		if limit, ok := resources.Limits[name]; ok && limit.Cmp(max) > 0 {
+			adjust(resources.Limits, "limit", name, max)
+		}
+		if request, ok := resources.Requests[name]; ok && request.Cmp(max) > 0 {
+			adjust(resources.Requests, "request", name, max)
+		}
+	}
+
+	for name, min := range item.Min {
+		if request, ok := resources.Requests[name]; ok && request.Cmp(min) < 0 {
+			adjust(resources.Requests, "request", name, min)
+		}
+		if limit, ok := resources.Limits[name]; ok && limit.Cmp(min) < 0 {
+			adjust(resources.Limits, "limit", name, min)
+		}
+	}
+
+	// the LimitRanger applies the default limit to containers without limits
+	for name, def := range item.Default {
+		if _, ok := resources.Limits[name]; ok {
+			continue
+		}
+		if request, ok := resources.Requests[name]; ok && request.Cmp(def) > 0 {
+			adjust(resources.Limits, "limit", name, request)
+		}
+	}
+
+	for name, ratio := range item.MaxLimitRequestRatio {
+		limit, hasLimit := resources.Limits[name]
+		request, hasRequest := resources.Requests[name]
+		if !hasLimit || !hasRequest || request.IsZero() {
+			continue
+		}
+		if minRequest, raise := ratioRequest(limit, request, ratio); raise {
+			quantity := resource.NewMilliQuantity(minRequest, request.Format)
+			if name != corev1.ResourceCPU {
+				// only the CPU is requested in milli units, e.g. the memory is rounded up to bytes
+				quantity = resource.NewQuantity((minRequest+999)/1000, request.Format)
+			}
+			adjust(resources.Requests, "request", name, *quantity)
+		}
+	}
+
+	for name, request := range resources.Requests {
+		if limit, ok := resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("Container %s %s request %s exceeds limit %s after applying the namespace LimitRange", container.Name, name, request.String(), limit.String())
+		}
+	}
+
+	return nil
+}
+
+// ratioRequest returns the lowest request, in milli units, keeping limit/request within ratio, and whether
+// request has to be raised to it. The milli values are multiplied in big integers, exact and without overflow.
+func ratioRequest(limit, request, ratio resource.Quantity) (int64, bool) {
+	limitMilli := big.NewInt(limit.MilliValue())
+	ratioMilli := big.NewInt(ratio.MilliValue())
+	if ratioMilli.Sign() <= 0 {
+		return 0, false
+	}
+
+	// limit / request > ratio / 1000  <=>  limit * 1000 > ratio * request
+	scaledLimit := new(big.Int).Mul(limitMilli, big.NewInt(1000))
+	if scaledLimit.Cmp(new(big.Int).Mul(ratioMilli, big.NewInt(request.MilliValue()))) <= 0 {
+		return 0, false
+	}
+
+	// rounded up, a truncated request would still exceed the ratio
+	minRequest, remainder := new(big.Int).QuoRem(scaledLimit, ratioMilli, new(big.Int))
+	if remainder.Sign() > 0 {
+		minRequest.Add(minRequest, big.NewInt(1))
+	}
+	return minRequest.Int64(), true
+}
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func resourceList(values map[corev1.ResourceName]string) corev1.ResourceList {
+	list := corev1.ResourceList{}
+	for name, value := range values {
+		list[name] = resource.MustParse(value)
+	}
+	return list
+}
+
+func TestFitLimitRange(t *testing.T) {
+	cpu, memory := corev1.ResourceCPU, corev1.ResourceMemory
+	tests := []struct {
+		name         string
+		requests     map[corev1.ResourceName]string
+		limits       map[corev1.ResourceName]string
+		item         corev1.LimitRangeItem
+		wantRequests map[corev1.ResourceName]string
+		wantLimits   map[corev1.ResourceName]string
+		wantErr      bool
+	}{
+		{
+			name:         "max lowers the limit and the request",
+			requests:     map[corev1.ResourceName]string{cpu: "750m"},
+			limits:       map[corev1.ResourceName]string{cpu: "1"},
+			item:         corev1.LimitRangeItem{Max: resourceList(map[corev1.ResourceName]string{cpu: "500m"})},
+			wantRequests: map[corev1.ResourceName]string{cpu: "500m"},
+			wantLimits:   map[corev1.ResourceName]string{cpu: "500m"},
+		},
+		{
+			name:         "max keeps the resources within",
+			requests:     map[corev1.ResourceName]string{memory: "64Mi"},
+			limits:       map[corev1.ResourceName]string{memory: "128Mi"},
+			item:         corev1.LimitRangeItem{Max: resourceList(map[corev1.ResourceName]string{memory: "1Gi"})},
+			wantRequests: map[corev1.ResourceName]string{memory: "64Mi"},
+			wantLimits:   map[corev1.ResourceName]string{memory: "128Mi"},
+		},
+		{
+			name:         "min raises the request and the limit",
+			requests:     map[corev1.ResourceName]string{memory: "16Mi"},
+			limits:       map[corev1.ResourceName]string{memory: "32Mi"},
+			item:         corev1.LimitRangeItem{Min: resourceList(map[corev1.ResourceName]string{memory: "64Mi"})},
+			wantRequests: map[corev1.ResourceName]string{memory: "64Mi"},
+			wantLimits:   map[corev1.ResourceName]string{memory: "64Mi"},
+		},
+		{
+			name:         "default limit below the request is raised to the request",
+			requests:     map[corev1.ResourceName]string{cpu: "500m"},
+			item:         corev1.LimitRangeItem{Default: resourceList(map[corev1.ResourceName]string{cpu: "250m"})},
+			wantRequests: map[corev1.ResourceName]string{cpu: "500m"},
+			wantLimits:   map[corev1.ResourceName]string{cpu: "500m"},
+		},
+		{
+			name:         "default limit above the request is left to the LimitRanger",
+			requests:     map[corev1.ResourceName]string{cpu: "100m"},
+			item:         corev1.LimitRangeItem{Default: resourceList(map[corev1.ResourceName]string{cpu: "250m"})},
+			wantRequests: map[corev1.ResourceName]string{cpu: "100m"},
+			wantLimits:   map[corev1.ResourceName]string{},
+		},
+		{
+			name:         "ratio forces the request up",
+			requests:     map[corev1.ResourceName]string{memory: "100Mi"},
+			limits:       map[corev1.ResourceName]string{memory: "1Gi"},
+			item:         corev1.LimitRangeItem{MaxLimitRequestRatio: resourceList(map[corev1.ResourceName]string{memory: "4"})},
+			wantRequests: map[corev1.ResourceName]string{memory: "256Mi"},
+			wantLimits:   map[corev1.ResourceName]string{memory: "1Gi"},
+		},
+		{
+			name:         "ratio rounds the request up",
+			requests:     map[corev1.ResourceName]string{cpu: "100m"},
+			limits:       map[corev1.ResourceName]string{cpu: "1"},
+			item:         corev1.LimitRangeItem{MaxLimitRequestRatio: resourceList(map[corev1.ResourceName]string{cpu: "3"})},
+			wantRequests: map[corev1.ResourceName]string{cpu: "334m"},
+			wantLimits:   map[corev1.ResourceName]string{cpu: "1"},
+		},
+		{
+			name:         "ratio rounds the memory request up to bytes",
+			requests:     map[corev1.ResourceName]string{memory: "100"},
+			limits:       map[corev1.ResourceName]string{memory: "1000"},
+			item:         corev1.LimitRangeItem{MaxLimitRequestRatio: resourceList(map[corev1.ResourceName]string{memory: "3"})},
+			wantRequests: map[corev1.ResourceName]string{memory: "334"},
+			wantLimits:   map[corev1.ResourceName]string{memory: "1000"},
+		},
+		{
+			name:         "ratio within is kept",
+			requests:     map[corev1.ResourceName]string{cpu: "250m"},
+			limits:       map[corev1.ResourceName]string{cpu: "1"},
+			item:         corev1.LimitRangeItem{MaxLimitRequestRatio: resourceList(map[corev1.ResourceName]string{cpu: "4"})},
+			wantRequests: map[corev1.ResourceName]string{cpu: "250m"},
+			wantLimits:   map[corev1.ResourceName]string{cpu: "1"},
+		},
+		{
+			name:     "request above the limit is rejected",
+			requests: map[corev1.ResourceName]string{cpu: "2"},
+			limits:   map[corev1.ResourceName]string{cpu: "1"},
+			item:     corev1.LimitRangeItem{Min: resourceList(map[corev1.ResourceName]string{cpu: "100m"})},
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		container := corev1.Container{
+			Name: "vault-agent",
+			Resources: corev1.ResourceRequirements{
+				Requests: resourceList(test.requests),
+				Limits:   resourceList(test.limits),
+			},
+		}
+		err := fitLimitRange(&container, test.item)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		assertResources(t, test.name+" requests", container.Resources.Requests, test.wantRequests)
+		assertResources(t, test.name+" limits", container.Resources.Limits, test.wantLimits)
+	}
+}
+
+func assertResources(t *testing.T, name string, got corev1.ResourceList, want map[corev1.ResourceName]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: %v, expected %v", name, got, want)
+		return
+	}
+	for resourceName, value := range want {
+		quantity, ok := got[resourceName]
+		if expected := resource.MustParse(value); !ok || quantity.Cmp(expected) != 0 {
+			t.Errorf("%s: %s %s, expected %s", name, resourceName, quantity.String(), value)
+		}
+	}
+}
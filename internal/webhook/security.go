@@ -0,0 +1,99 @@
+package webhook
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// SeccompPodAnnotationKey represents the key of a seccomp profile applied to all containers of a pod
+	SeccompPodAnnotationKey = "seccomp.security.alpha.kubernetes.io/pod"
+	// SeccompContainerAnnotationKeyPrefix represents the key of a seccomp profile applied to one container of a pod
+	SeccompContainerAnnotationKeyPrefix = "container.seccomp.security.alpha.kubernetes.io/"
+)
+
+// NewSidecarSecurityContext resolves the security context of the injected containers
+// from the application container, the pod and the configured fallback values
+func NewSidecarSecurityContext(pod *corev1.Pod, container *corev1.Container, fallback SidecarSecurityContext) SidecarSecurityContext {
+	sc := SidecarSecurityContext{}
+
+	if container.SecurityContext != nil {
+		sc.RunAsUser = container.SecurityContext.RunAsUser
+		sc.RunAsGroup = container.SecurityContext.RunAsGroup
+	}
+
+	if pod.Spec.SecurityContext != nil {
+		if sc.RunAsUser == nil {
+			sc.RunAsUser = pod.Spec.SecurityContext.RunAsUser
+		}
+		if sc.RunAsGroup == nil {
+			sc.RunAsGroup = pod.Spec.SecurityContext.RunAsGroup
+		}
+		sc.FSGroup = pod.Spec.SecurityContext.FSGroup
+	}
+
+	if sc.RunAsUser == nil {
+		sc.RunAsUser = fallback.RunAsUser
+	}
+	if sc.RunAsGroup == nil {
+		sc.RunAsGroup = fallback.RunAsGroup
+	}
+	if sc.FSGroup == nil {
+		sc.FSGroup = fallback.FSGroup
+	}
+
+	annotations := pod.GetAnnotations()
+	if profile, ok := annotations[SeccompContainerAnnotationKeyPrefix+container.Name]; ok {
+		sc.SeccompProfile = profile
+	} else if profile, ok := annotations[SeccompPodAnnotationKey]; ok {
+		sc.SeccompProfile = profile
+	} else {
+		sc.SeccompProfile = fallback.SeccompProfile
+	}
+
+	return sc
+}
+
+// applySecurityContext sets the resolved security context to every injected container
+func applySecurityContext(sic *SidecarInject, pod *corev1.Pod, sc SidecarSecurityContext) {
+	for i := range sic.InitContainers {
+		mergeSecurityContext(&sic.InitContainers[i], sc)
+	}
+	for i := range sic.Containers {
+		mergeSecurityContext(&sic.Containers[i], sc)
+	}
+
+	// fsGroup is pod level, it is only set when the pod does not define it
+	if sc.FSGroup != nil && (pod.Spec.SecurityContext == nil || pod.Spec.SecurityContext.FSGroup == nil) {
+		if sic.SecurityContext == nil {
+			sic.SecurityContext = &corev1.PodSecurityContext{}
+		}
+		sic.SecurityContext.FSGroup = sc.FSGroup
+	}
+}
+
+func mergeSecurityContext(container *corev1.Container, sc SidecarSecurityContext) {
+	if sc.RunAsUser == nil && sc.RunAsGroup == nil {
+		return
+	}
+	if container.SecurityContext == nil {
+		container.SecurityContext = &corev1.SecurityContext{}
+	}
+	if sc.RunAsUser != nil {
+		container.SecurityContext.RunAsUser = sc.RunAsUser
+	}
+	if sc.RunAsGroup != nil {
+		container.SecurityContext.RunAsGroup = sc.RunAsGroup
+	}
+}
+
+// seccompAnnotations returns the seccomp annotations for the injected containers
+func seccompAnnotations(sic *SidecarInject, sc SidecarSecurityContext) map[string]string {
+	annotations := make(map[string]string)
+	if sc.SeccompProfile == "" {
+		return annotations
+	}
+	for _, name := range ContainerNames(sic) {
+		annotations[SeccompContainerAnnotationKeyPrefix+name] = sc.SeccompProfile
+	}
+	return annotations
+}
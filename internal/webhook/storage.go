@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// ConfigStorageConfigMap stores the rendered agent config in a ConfigMap
+	ConfigStorageConfigMap = "configmap"
+	// ConfigStorageSecret stores the rendered agent config in a Secret, for the templates embedding credentials
+	ConfigStorageSecret = "secret"
+)
+
+// ValidateConfigStorage verifies the agent config storage is supported
+func ValidateConfigStorage(storage string) error {
+	switch storage {
+	case ConfigStorageConfigMap, ConfigStorageSecret:
+		return nil
+	}
+	return fmt.Errorf("Unsupported agent config storage %s, expected %s or %s", storage, ConfigStorageConfigMap, ConfigStorageSecret)
+}
+
+// createOrUpdateSecret creates the desired Secret or updates the current one when the data hash changed,
+// the Secrets not created by the webhook are never overwritten
+func (wk *WebHook) createOrUpdateSecret(ctx context.Context, desired *corev1.Secret, hash string) (*corev1.Secret, error) {
+	var result *corev1.Secret
+
+	err := retryWrite(ctx, func(fresh bool) error {
+		if fresh {
+			log.Debugf("Retrying write of Secret %s/%s", desired.Namespace, desired.Name)
+		}
+		current, err := kube.GetSecret(ctx, wk.Client, desired.Namespace, desired.Name)
+		switch {
+		case errors.IsNotFound(err):
+			result, err = kube.CreateSecret(ctx, wk.Client, desired)
+		case err != nil:
+		case !isManaged(&current.ObjectMeta):
+			err = fmt.Errorf("Secret %s/%s is not managed by the webhook, label it %s=%s to store the agent config",
+				desired.Namespace, desired.Name, kube.ManagedByLabel, kube.ManagedByValue)
+		case current.Annotations[DataHashAnnotation] != hash || dataHash(stringData(current.Data)) != hash:
+			current.Data = desired.Data
+			setDataHash(&current.ObjectMeta, hash)
+			result, err = kube.UpdateSecret(ctx, wk.Client, current)
+		default:
+			log.Debugf("Secret %s/%s unchanged, write skipped", desired.Namespace, desired.Name)
+			result = current
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// setAgentConfig records the name of the agent config ConfigMap or Secret
+func (d *InjectionDetails) setAgentConfig(storage, name string) {
+	d.ConfigMap, d.AgentSecret = "", ""
+	if storage == ConfigStorageSecret {
+		d.AgentSecret = name
+	} else {
+		d.ConfigMap = name
+	}
+}
+
+// agentConfigStorage returns the storage of the agent config at injection time
+func (d *InjectionDetails) agentConfigStorage() string {
+	if d.AgentSecret != "" {
+		return ConfigStorageSecret
+	}
+	return ConfigStorageConfigMap
+}
+
+// secretData converts the rendered agent config to the Secret data
+func secretData(data map[string]string) map[string][]byte {
+	secret := make(map[string][]byte, len(data))
+	for key, value := range data {
+		secret[key] = []byte(value)
+	}
+	return secret
+}
+
+// stringData converts the Secret data back to the rendered agent config
+func stringData(secret map[string][]byte) map[string]string {
+	data := make(map[string]string, len(secret))
+	for key, value := range secret {
+		data[key] = string(value)
+	}
+	return data
+}
+
+// podConfigStorage returns the storage of the pod agent config, the annotation can only raise the storage
+// to a Secret, the agent configs the webhook keeps in Secrets are never stored in ConfigMaps
+func podConfigStorage(pod *corev1.Pod, storage string) string {
+	if GetAnnotationValue(*pod, annotationConfigStorage, storage) == ConfigStorageSecret {
+		return ConfigStorageSecret
+	}
+	return storage
+}
+
+// useSecretVolume switches the volumes of the agent config ConfigMap to the Secret of the same name,
+// the sidecar templates are not aware of the storage
+func useSecretVolume(sic *SidecarInject, name string) {
+	for i := range sic.Volumes {
+		configMap := sic.Volumes[i].ConfigMap
+		if configMap == nil || configMap.Name != name {
+			continue
+		}
+		sic.Volumes[i].VolumeSource = corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  name,
+				Items:       configMap.Items,
+				DefaultMode: configMap.DefaultMode,
+				Optional:    configMap.Optional,
+			},
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestUseSecretVolume(t *testing.T) {
+	mode := int32(0440)
+	optional := true
+	items := []corev1.KeyToPath{{Key: "agent.config", Path: "agent.config"}}
+	sic := &SidecarInject{Volumes: []corev1.Volume{
+		{Name: "vault-config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "vault-agent-config-app"},
+			Items:                items,
+			DefaultMode:          &mode,
+			Optional:             &optional,
+		}}},
+		{Name: "vault-cabundle", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: CABundleConfigMapName},
+		}}},
+	}}
+
+	useSecretVolume(sic, "vault-agent-config-app")
+
+	config := sic.Volumes[0]
+	if config.ConfigMap != nil || config.Secret == nil {
+		t.Fatalf("vault-config not switched to a secret volume: %+v", config.VolumeSource)
+	}
+	if config.Secret.SecretName != "vault-agent-config-app" {
+		t.Errorf("secret volume references %s", config.Secret.SecretName)
+	}
+	if len(config.Secret.Items) != 1 || config.Secret.Items[0] != items[0] {
+		t.Errorf("items not carried over: %+v", config.Secret.Items)
+	}
+	if config.Secret.DefaultMode == nil || *config.Secret.DefaultMode != mode {
+		t.Errorf("defaultMode not carried over: %v", config.Secret.DefaultMode)
+	}
+	if config.Secret.Optional == nil || !*config.Secret.Optional {
+		t.Errorf("optional not carried over: %v", config.Secret.Optional)
+	}
+
+	caBundle := sic.Volumes[1]
+	if caBundle.Secret != nil || caBundle.ConfigMap == nil || caBundle.ConfigMap.Name != CABundleConfigMapName {
+		t.Errorf("CA bundle volume changed: %+v", caBundle.VolumeSource)
+	}
+}
+
+func TestConfigStorageAnnotation(t *testing.T) {
+	tests := []struct {
+		global     string
+		annotation string
+		want       string
+	}{
+		{ConfigStorageConfigMap, "", ConfigStorageConfigMap},
+		{ConfigStorageConfigMap, ConfigStorageSecret, ConfigStorageSecret},
+		{ConfigStorageSecret, "", ConfigStorageSecret},
+		{ConfigStorageSecret, ConfigStorageConfigMap, ConfigStorageSecret},
+	}
+	for _, test := range tests {
+		pod := testPod()
+		if test.annotation != "" {
+			pod.Annotations[annotationConfigStorage.name] = test.annotation
+		}
+		data, err := NewSidecarData(pod, SidecarSecurityContext{}, test.global)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.ConfigStorage != test.want {
+			t.Errorf("global %s, annotation %q: storage %s, expected %s", test.global, test.annotation, data.ConfigStorage, test.want)
+		}
+		wk := &WebHook{ConfigStorage: test.global}
+		if kind := wk.agentConfigKind(pod); (kind == "Secret") != (test.want == ConfigStorageSecret) {
+			t.Errorf("global %s, annotation %q: event kind %s, expected storage %s", test.global, test.annotation, kind, test.want)
+		}
+	}
+}
+
+func TestReinjectKeepsStorage(t *testing.T) {
+	tests := []struct {
+		name     string
+		global   string
+		injected func(*InjectionDetails)
+		resource string
+	}{
+		{"configmap", ConfigStorageSecret, func(d *InjectionDetails) { d.ConfigMap = "vault-agent-config-app" }, "configmaps"},
+		{"secret", ConfigStorageConfigMap, func(d *InjectionDetails) { d.AgentSecret = "vault-agent-config-app" }, "secrets"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &fakeAPI{}
+			server := httptest.NewServer(api)
+			defer server.Close()
+			client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wk := &WebHook{
+				SidecarConfig: loadShippedConfig(t),
+				Client:        client,
+				FailureMode:   FailureModeClosed,
+				ConfigStorage: test.global,
+			}
+
+			details := InjectionDetails{DataHash: "stale", Containers: []string{"vault-agent"}}
+			test.injected(&details)
+			value, err := InjectionDetailsValue(details)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pod := testPod()
+			pod.Annotations[annotationStatus.name] = "injected"
+			pod.Annotations[annotationInjection.name] = value
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "vault-agent", Image: "vault:1.3.2"})
+
+			response := wk.reinject(context.Background(), &v1.AdmissionRequest{UID: "uid", Operation: v1.Update}, pod)
+			if !response.Allowed {
+				t.Fatalf("reinject rejected: %+v", response.Result)
+			}
+
+			created := api.created()
+			if len(created) != 1 || created[0] != test.resource {
+				t.Errorf("created %v, expected the agent config in %s", created, test.resource)
+			}
+			if !strings.Contains(string(response.Patch), "vault-agent-config-app") {
+				t.Errorf("injection details do not record the agent config: %s", response.Patch)
+			}
+		})
+	}
+}
+
+func TestAgentConfigWrites(t *testing.T) {
+	api := &fakeAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	wk := &WebHook{SidecarConfig: loadShippedConfig(t), Client: fakeClient(t, server), ConfigStorage: ConfigStorageConfigMap}
+	pod := testPod()
+	data, err := NewSidecarData(pod, SidecarSecurityContext{}, ConfigStorageConfigMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(step string, want ...string) {
+		if _, err := agentConfig(context.Background(), VaultAgentConfigPrefix, *pod, wk, data, false); err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		assertRequests(t, step, api.served(), want)
+	}
+
+	write("create", "GET configmaps", "POST configmaps")
+	created := api.configMap(t, pod.Namespace, VaultAgentConfigPrefix+"-"+data.Name)
+	write("unchanged", "GET configmaps")
+
+	// the data is edited, the hash annotation is kept
+	edited := created.DeepCopy()
+	edited.Data["agent.config"] = "edited"
+	api.putConfigMap(t, edited)
+	write("edited", "GET configmaps", "PUT configmaps")
+	if restored := api.configMap(t, pod.Namespace, created.Name); restored.Data["agent.config"] != created.Data["agent.config"] {
+		t.Errorf("edited agent config not rewritten: %q", restored.Data["agent.config"])
+	}
+}
+
+func TestConfigMapWriteRetries(t *testing.T) {
+	desired := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-agent-config-app", Namespace: "app", Labels: managedLabels()},
+		Data:       map[string]string{"agent.config": "new"},
+	}
+	update := func(current *corev1.ConfigMap) bool {
+		if current.Data["agent.config"] == desired.Data["agent.config"] {
+			return false
+		}
+		current.Data = desired.Data
+		return true
+	}
+	// another replica writes the desired ConfigMap first
+	replica := func(t *testing.T, method string, reason metav1.StatusReason) func(a *fakeAPI, method, resource string) *metav1.Status {
+		failed := false
+		return func(a *fakeAPI, m, resource string) *metav1.Status {
+			if m != method || failed {
+				return nil
+			}
+			failed = true
+			a.putConfigMap(t, desired)
+			return &metav1.Status{Reason: reason, Code: http.StatusConflict}
+		}
+	}
+
+	t.Run("already exists", func(t *testing.T) {
+		api := &fakeAPI{}
+		api.fail = replica(t, http.MethodPost, metav1.StatusReasonAlreadyExists)
+		server := httptest.NewServer(api)
+		defer server.Close()
+		wk := &WebHook{Client: fakeClient(t, server)}
+
+		result, err := wk.createOrUpdateConfigMap(context.Background(), desired.DeepCopy(), update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertRequests(t, "already exists", api.served(), []string{"GET configmaps", "POST configmaps", "GET configmaps"})
+		if result.Data["agent.config"] != "new" {
+			t.Errorf("ConfigMap of the other replica not returned: %v", result.Data)
+		}
+	})
+
+	t.Run("conflict re-reads the API server", func(t *testing.T) {
+		api := &fakeAPI{}
+		server := httptest.NewServer(api)
+		defer server.Close()
+		stale := desired.DeepCopy()
+		stale.Data = map[string]string{"agent.config": "old"}
+		stale = api.putConfigMap(t, stale)
+		api.fail = replica(t, http.MethodPut, metav1.StatusReasonConflict)
+		api.served()
+
+		// the informer cache has not seen the write of the other replica
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		if err := indexer.Add(stale); err != nil {
+			t.Fatal(err)
+		}
+		wk := &WebHook{
+			Client:    fakeClient(t, server),
+			Informers: &kube.Informers{ConfigMaps: corelisters.NewConfigMapLister(indexer)},
+		}
+
+		if _, err := wk.createOrUpdateConfigMap(context.Background(), desired.DeepCopy(), update); err != nil {
+			t.Fatal(err)
+		}
+		// the retry reads the ConfigMap of the other replica and skips the write
+		assertRequests(t, "conflict", api.served(), []string{"PUT configmaps", "GET configmaps"})
+	})
+}
+
+func fakeClient(t *testing.T, server *httptest.Server) kubernetes.Interface {
+	t.Helper()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func assertRequests(t *testing.T, name string, got, want []string) {
+	t.Helper()
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("%s: requests %v, expected %v", name, got, want)
+	}
+}
+
+func testPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app-5d8f7c9b4-x2x7z",
+			Namespace:       "app",
+			Annotations:     map[string]string{annotationPolicy.name: "true"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "app-5d8f7c9b4"}},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app:1.0"}}},
+	}
+}
+
+// fakeAPI answers the ConfigMap and Secret requests as a namespace holding objects would. fail is called before
+// every request and answers it with the returned status instead, to simulate the writes of another replica.
+type fakeAPI struct {
+	mu       sync.Mutex
+	objects  map[string]map[string]interface{}
+	requests []string
+	version  int
+	fail     func(a *fakeAPI, method, resource string) *metav1.Status
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// /api/v1/namespaces/<namespace>/<resource>[/<name>]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	namespace, resource := parts[0], parts[1]
+
+	a.mu.Lock()
+	a.requests = append(a.requests, r.Method+" "+resource)
+	a.mu.Unlock()
+	if a.fail != nil {
+		if status := a.fail(a, r.Method, resource); status != nil {
+			writeStatus(w, status)
+			return
+		}
+	}
+
+	if r.Method == http.MethodGet {
+		object, ok := a.get(resource, namespace, parts[2])
+		if !ok {
+			writeStatus(w, &metav1.Status{Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+			return
+		}
+		json.NewEncoder(w).Encode(object)
+		return
+	}
+
+	var object map[string]interface{}
+	body, _ := ioutil.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &object); err != nil {
+		writeStatus(w, &metav1.Status{Reason: metav1.StatusReasonBadRequest, Code: http.StatusBadRequest})
+		return
+	}
+	object = a.put(resource, object)
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(object)
+}
+
+// put stores the object with a new resourceVersion
+func (a *fakeAPI) put(resource string, object map[string]interface{}) map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.objects == nil {
+		a.objects = make(map[string]map[string]interface{})
+	}
+	a.version++
+	metadata := object["metadata"].(map[string]interface{})
+	metadata["resourceVersion"] = strconv.Itoa(a.version)
+	a.objects[resource+"/"+metadata["namespace"].(string)+"/"+metadata["name"].(string)] = object
+	return object
+}
+
+func (a *fakeAPI) get(resource, namespace, name string) (map[string]interface{}, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	object, ok := a.objects[resource+"/"+namespace+"/"+name]
+	return object, ok
+}
+
+// configMap returns the stored ConfigMap
+func (a *fakeAPI) configMap(t *testing.T, namespace, name string) *corev1.ConfigMap {
+	t.Helper()
+	object, ok := a.get("configmaps", namespace, name)
+	if !ok {
+		t.Fatalf("ConfigMap %s/%s not stored", namespace, name)
+	}
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := json.Unmarshal(raw, configMap); err != nil {
+		t.Fatal(err)
+	}
+	return configMap
+}
+
+// putConfigMap stores the ConfigMap as another client would
+func (a *fakeAPI) putConfigMap(t *testing.T, configMap *corev1.ConfigMap) *corev1.ConfigMap {
+	t.Helper()
+	raw, err := json.Marshal(configMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(raw, &object); err != nil {
+		t.Fatal(err)
+	}
+	a.put("configmaps", object)
+	return a.configMap(t, configMap.Namespace, configMap.Name)
+}
+
+// created returns the resources of the create requests
+func (a *fakeAPI) created() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var resources []string
+	for _, request := range a.requests {
+		if strings.HasPrefix(request, http.MethodPost+" ") {
+			resources = append(resources, strings.TrimPrefix(request, http.MethodPost+" "))
+		}
+	}
+	return resources
+}
+
+// served returns the requests answered since the last call, e.g. "PUT configmaps"
+func (a *fakeAPI) served() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	requests := a.requests
+	a.requests = nil
+	return requests
+}
+
+func writeStatus(w http.ResponseWriter, status *metav1.Status) {
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	status.Status = metav1.StatusFailure
+	w.WriteHeader(int(status.Code))
+	json.NewEncoder(w).Encode(status)
+}
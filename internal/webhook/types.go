@@ -1,13 +1,35 @@
 package webhook
 
 import (
+	"text/template"
+	"time"
+
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 // WebHook defines the webhook configuration
 type WebHook struct {
-	SidecarConfig *SidecarConfig
-	VaultConfig   *SidecarInject
+	SidecarConfig   *SidecarConfig
+	SecurityContext SidecarSecurityContext
+	CABundle        CABundleSource
+	Redactor        *Redactor
+	Auditor         *Auditor
+	Events          *EventNotifier
+	Client          kubernetes.Interface
+	Informers       *kube.Informers
+	Budget          time.Duration
+	FailureMode     string
+	ConfigStorage   string
+}
+
+// CABundleSource defines where the Vault CA bundle copied into the application namespace comes from
+type CABundleSource struct {
+	Source    string
+	Namespace string
+	Name      string
+	Key       string
 }
 
 // SidecarConfig defines the sidecar ConfigMap configuration
@@ -15,25 +37,58 @@ type SidecarConfig struct {
 	Template           string `json:"template"`
 	VaultAgentConfig   string `json:"agent.config"`
 	VaultAgentTemplate string `json:"template.ctmpl"`
+	CABundle           string `json:"service-ca.crt"`
+	Hash               string `json:"-"`
+	templates          map[string]*template.Template
+	err                error
 }
 
 // SidecarData defines data to be injected in the template
 type SidecarData struct {
-	Name          string
-	Container     corev1.Container
-	TokenVolume   string
-	VaultSecret   string
-	VaultFileName string
-	VaultRole     string
-	VaultInit     bool
+	Name            string
+	Container       corev1.Container
+	TokenVolume     string
+	VaultSecret     string
+	VaultFileName   string
+	VaultRole       string
+	VaultInit       bool
+	MountPath       string
+	ConfigStorage   string
+	Resources       corev1.ResourceRequirements
+	SecurityContext SidecarSecurityContext
+	Annotations     map[string]string
+	Labels          map[string]string
+
+	// sample is set on the data rendered at load time to validate the templates
+	sample bool
+}
+
+// SidecarSecurityContext defines the security context resolved for the injected containers
+type SidecarSecurityContext struct {
+	RunAsUser      *int64
+	RunAsGroup     *int64
+	FSGroup        *int64
+	SeccompProfile string
 }
 
 // SidecarInject defines the content to be injected
 type SidecarInject struct {
-	InitContainers []corev1.Container   `yaml:"initContainers"`
-	Containers     []corev1.Container   `yaml:"containers"`
-	Volumes        []corev1.Volume      `yaml:"volumes"`
-	VolumeMount    []corev1.VolumeMount `yaml:"volumeMounts"`
+	InitContainers  []corev1.Container         `json:"initContainers"`
+	Containers      []corev1.Container         `json:"containers"`
+	Volumes         []corev1.Volume            `json:"volumes"`
+	VolumeMount     []corev1.VolumeMount       `json:"volumeMounts"`
+	SecurityContext *corev1.PodSecurityContext `json:"securityContext"`
+}
+
+// InjectionDetails records how the sidecar has been injected into a pod
+type InjectionDetails struct {
+	ConfigHash  string   `json:"configHash"`
+	DataHash    string   `json:"dataHash"`
+	Version     string   `json:"version"`
+	Secrets     []string `json:"secrets"`
+	ConfigMap   string   `json:"configMap,omitempty"`
+	AgentSecret string   `json:"agentSecret,omitempty"`
+	Containers  []string `json:"containers"`
 }
 
 type registeredAnnotation struct {
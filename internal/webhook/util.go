@@ -1,47 +1,189 @@
 package webhook
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path"
 	"regexp"
 	"strings"
 
-	"github.com/ghodss/yaml"
 	v1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
-// Load a yaml file
-func Load(file string, c interface{}) {
+// Load the sidecar config yaml file and parses its templates,
+// config is only replaced by a valid configuration, otherwise it records the failure reported by Check
+func Load(file string, config *SidecarConfig) (err error) {
+	defer func() {
+		if err != nil {
+			config.err = err
+		}
+	}()
 
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		log.Fatalln(err)
+		return err
+	}
+
+	loaded := SidecarConfig{}
+	if err := strictUnmarshal(data, &loaded, field.NewPath("sidecarconfig")); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", file, err)
+	}
+
+	if err := parseTemplates(&loaded); err != nil {
+		return fmt.Errorf("Invalid sidecar config %s: %v", file, err)
+	}
+
+	// render the template with sample data to catch broken templates before the first admission
+	if _, err := inject(context.Background(), sampleSidecarData(), &loaded); err != nil {
+		return fmt.Errorf("Invalid sidecar config %s: %v", file, err)
+	}
+
+	loaded.Hash = fmt.Sprintf("%x", sha256.Sum256(data))
+	*config = loaded
+	log.Infof("New configuration %s: sha256sum %s", file, config.Hash)
+	return nil
+}
+
+// ValidateMountPaths verifies the added volume mounts do not overlap the existing mounts of the container
+func ValidateMountPaths(container corev1.Container, added []corev1.VolumeMount) error {
+	for _, add := range added {
+		for _, existing := range container.VolumeMounts {
+			if pathOverlaps(add.MountPath, existing.MountPath) {
+				return fmt.Errorf("Mount path %s overlaps %s mounted from %s in container %s", add.MountPath, existing.MountPath, existing.Name, container.Name)
+			}
+		}
 	}
+	return nil
+}
 
-	if err := yaml.Unmarshal(data, c); err != nil {
-		log.Warnf("Failed to parse %s", string(data))
+// pathOverlaps returns true when the paths are equal or one is the parent of the other
+func pathOverlaps(a, b string) bool {
+	a, b = path.Clean(a), path.Clean(b)
+	if a == b || a == "/" || b == "/" {
+		return true
 	}
+	return strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
 
-	log.Debugf("New configuration: sha256sum %x", sha256.Sum256(data))
-	log.Infof("SidecarConfig: %v", c)
+// Check verifies the sidecar config has been loaded
+func (c *SidecarConfig) Check() error {
+	if c.err != nil {
+		return fmt.Errorf("sidecar config not loaded: %v", c.err)
+	}
+	if c.templates == nil {
+		return fmt.Errorf("sidecar config not loaded")
+	}
+	return nil
+}
+
+// Validate verifies the CA bundle source settings
+func (s CABundleSource) Validate() error {
+	switch s.Source {
+	case CABundleSourceOpenShift, CABundleSourceEmbedded:
+		return nil
+	case CABundleSourceSecret, CABundleSourceConfigMap:
+		if s.Name == "" || s.Key == "" {
+			return fmt.Errorf("CA bundle source %s requires the name and the key", s.Source)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported CA bundle source %s, expected %s, %s, %s or %s", s.Source,
+		CABundleSourceOpenShift, CABundleSourceSecret, CABundleSourceConfigMap, CABundleSourceEmbedded)
+}
+
+// sampleSidecarData returns the data used to validate the templates at load time
+func sampleSidecarData() *SidecarData {
+	return &SidecarData{
+		Name: "example",
+		Container: corev1.Container{
+			Name:  "example",
+			Image: "example",
+		},
+		TokenVolume:   "example-token",
+		VaultSecret:   "secret/example",
+		VaultFileName: "application.yaml",
+		VaultRole:     "example",
+		MountPath:     DefaultMountPath,
+		ConfigStorage: ConfigStorageConfigMap,
+		Annotations:   map[string]string{},
+		Labels:        map[string]string{},
+		sample:        true,
+	}
+}
+
+// InjectionDetailsValue returns the JSON representation of the injection details
+func InjectionDetailsValue(details InjectionDetails) (string, error) {
+	ba, err := json.Marshal(details)
+	if err != nil {
+		return "", err
+	}
+	return string(ba), nil
+}
+
+// GetInjectionDetails returns the injection details recorded on a Pod
+func GetInjectionDetails(pod corev1.Pod) (*InjectionDetails, error) {
+	details := InjectionDetails{}
+	value := GetAnnotationValue(pod, annotationInjection, "")
+	if value == "" {
+		return &details, nil
+	}
+	if err := json.Unmarshal([]byte(value), &details); err != nil {
+		return nil, fmt.Errorf("Invalid %s annotation: %v", annotationInjection.name, err)
+	}
+	return &details, nil
+}
+
+// DataHash returns the sha256sum of the sidecar config and the webhook annotations of a Pod
+func DataHash(config *SidecarConfig, pod *corev1.Pod) string {
+	annotations := make(map[string]string)
+	for key, value := range pod.GetAnnotations() {
+		if strings.HasPrefix(key, AnnotationPrefix) && key != annotationStatus.name && key != annotationInjection.name && key != annotationFailure.name {
+			annotations[key] = value
+		}
+	}
+	// json.Marshal sorts the map keys, the result is stable
+	ba, _ := json.Marshal(annotations)
+	return fmt.Sprintf("%x", sha256.Sum256(append([]byte(config.Hash), ba...)))
+}
+
+// ContainerNames returns the names of the injected containers and init containers
+func ContainerNames(sic *SidecarInject) []string {
+	var names []string
+	for _, c := range sic.InitContainers {
+		names = append(names, c.Name)
+	}
+	for _, c := range sic.Containers {
+		names = append(names, c.Name)
+	}
+	return names
 }
 
 // Pod unmarshalls byte to corev1.Pod
 func Pod(raw []byte, pod *corev1.Pod) error {
 
-	log.Debugf("Object: %v", string(raw))
 	if err := json.Unmarshal(raw, pod); err != nil {
 		log.Errorln(err)
 		return err
 	}
-	log.Debugf("Pod: %v", pod)
 	return nil
 }
 
+// PodOwner returns the kind and name of the pod controller
+func PodOwner(pod *corev1.Pod) string {
+	if len(pod.OwnerReferences) == 0 {
+		return ""
+	}
+	return pod.OwnerReferences[0].Kind + "/" + pod.OwnerReferences[0].Name
+}
+
 // GetAnnotationValue returns the vaule of annotation from a Pod
 func GetAnnotationValue(pod corev1.Pod, name *registeredAnnotation, defaultValue string) string {
 	metadata := pod.ObjectMeta
@@ -59,10 +201,11 @@ func GetDeploymentName(name string) (string, error) {
 	return "", fmt.Errorf("Wrong string format %s, expected version number", name)
 }
 
-// ToAdmissionResponseError creates a not allowed AdmissionResponse
-func ToAdmissionResponseError(err error) *v1.AdmissionResponse {
+// ToAdmissionResponseError creates a not allowed AdmissionResponse for the request uid
+func ToAdmissionResponseError(uid types.UID, err error) *v1.AdmissionResponse {
 	log.Errorln(err)
 	return &v1.AdmissionResponse{
+		UID:     uid,
 		Allowed: false,
 		Result: &metav1.Status{
 			Message: err.Error(),
@@ -89,6 +232,87 @@ func PotentialNamespace(req *v1.AdmissionRequest, pod *corev1.Pod) string {
 	return pod.ObjectMeta.Namespace
 }
 
+// ValidateAnnotations runs the registered validators against the Pod annotations
+func ValidateAnnotations(pod corev1.Pod) error {
+	annotations := pod.GetAnnotations()
+	for _, registered := range annotationRegistry {
+		if value, ok := annotations[registered.name]; ok {
+			if err := registered.validator(value); err != nil {
+				return fmt.Errorf("Invalid annotation %s=%s: %v", registered.name, value, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AgentResources returns the agent resource requirements defined by the Pod annotations
+func AgentResources(pod corev1.Pod) (corev1.ResourceRequirements, error) {
+	resources := corev1.ResourceRequirements{}
+	quantities := []struct {
+		annotation *registeredAnnotation
+		name       corev1.ResourceName
+		list       *corev1.ResourceList
+	}{
+		{annotationCPURequest, corev1.ResourceCPU, &resources.Requests},
+		{annotationCPULimit, corev1.ResourceCPU, &resources.Limits},
+		{annotationMemoryRequest, corev1.ResourceMemory, &resources.Requests},
+		{annotationMemoryLimit, corev1.ResourceMemory, &resources.Limits},
+	}
+
+	for _, q := range quantities {
+		value := GetAnnotationValue(pod, q.annotation, "")
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return resources, fmt.Errorf("Invalid annotation %s=%s: %v", q.annotation.name, value, err)
+		}
+		if *q.list == nil {
+			*q.list = corev1.ResourceList{}
+		}
+		(*q.list)[q.name] = quantity
+	}
+
+	for name, request := range resources.Requests {
+		if limit, ok := resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return resources, fmt.Errorf("Agent %s request %s exceeds limit %s", name, request.String(), limit.String())
+		}
+	}
+
+	return resources, nil
+}
+
+// NewSidecarData collects the template data from a Pod
+func NewSidecarData(pod *corev1.Pod, fallback SidecarSecurityContext, storage string) (*SidecarData, error) {
+	if len(pod.OwnerReferences) == 0 {
+		return nil, fmt.Errorf("Pod %s has no owner, expected a controller", pod.Name)
+	}
+	name, err := GetDeploymentName(pod.OwnerReferences[0].Name)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := AgentResources(*pod)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SidecarData{
+		Name:            name,
+		Container:       pod.Spec.Containers[0],
+		TokenVolume:     FindTokenVolumeName(pod.Spec.Volumes),
+		VaultSecret:     GetAnnotationValue(*pod, annotationSecret, ""),
+		VaultFileName:   GetAnnotationValue(*pod, annotationVaultFileName, "application.yaml"),
+		VaultRole:       GetAnnotationValue(*pod, annotationVaultRole, DefaultVaultRole),
+		MountPath:       GetAnnotationValue(*pod, annotationMountPath, DefaultMountPath),
+		ConfigStorage:   podConfigStorage(pod, storage),
+		Resources:       resources,
+		SecurityContext: NewSidecarSecurityContext(pod, &pod.Spec.Containers[0], fallback),
+		Annotations:     pod.GetAnnotations(),
+		Labels:          pod.GetLabels(),
+	}, nil
+}
+
 // FindTokenVolumeName retrieves the Secret -token types volume
 func FindTokenVolumeName(volumes []corev1.Volume) string {
 	for _, vol := range volumes {
@@ -99,17 +323,6 @@ func FindTokenVolumeName(volumes []corev1.Volume) string {
 	return ""
 }
 
-// FindVolumeMount returns the volume mount entry
-func FindVolumeMount(volumes []corev1.VolumeMount, name string) corev1.VolumeMount {
-	for _, vol := range volumes {
-		if strings.Contains(vol.Name, name) {
-			log.Debugln("VolumeMount found", vol.Name)
-			return vol
-		}
-	}
-	return corev1.VolumeMount{}
-}
-
 // getValueOrDefault is a helper method to return a default from annotation
 func (v *registeredAnnotation) getValueOrDefault(annotations map[string]string, defaultValue string) string {
 	if val, ok := annotations[v.name]; ok {
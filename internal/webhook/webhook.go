@@ -1,13 +1,22 @@
 package webhook
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"path"
 
 	"github.com/gin-gonic/gin"
 	logger "github.com/openlab-red/mutating-webhook-vault-agent/internal/logrus"
+	"github.com/openlab-red/mutating-webhook-vault-agent/internal/tracing"
+	"github.com/openlab-red/mutating-webhook-vault-agent/internal/version"
+	"github.com/openlab-red/mutating-webhook-vault-agent/pkg/kube"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/api/kv"
 	v1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
@@ -22,12 +31,32 @@ var (
 		return nil
 	}
 
+	quantityValidFunc = func(value string) error {
+		_, err := resource.ParseQuantity(value)
+		return err
+	}
+
+	absolutePathValidFunc = func(value string) error {
+		if !path.IsAbs(value) {
+			return fmt.Errorf("must be an absolute path")
+		}
+		return nil
+	}
+
 	annotationRegistry = []*registeredAnnotation{
 		{"sidecar.agent.vaultproject.io/inject", alwaysValidFunc},
 		{"sidecar.agent.vaultproject.io/status", alwaysValidFunc},
 		{"sidecar.agent.vaultproject.io/secret", alwaysValidFunc},
 		{"sidecar.agent.vaultproject.io/filename", alwaysValidFunc},
 		{"sidecar.agent.vaultproject.io/role", alwaysValidFunc},
+		{"sidecar.agent.vaultproject.io/injection", alwaysValidFunc},
+		{"sidecar.agent.vaultproject.io/agent-cpu-request", quantityValidFunc},
+		{"sidecar.agent.vaultproject.io/agent-cpu-limit", quantityValidFunc},
+		{"sidecar.agent.vaultproject.io/agent-memory-request", quantityValidFunc},
+		{"sidecar.agent.vaultproject.io/agent-memory-limit", quantityValidFunc},
+		{"sidecar.agent.vaultproject.io/mount-path", absolutePathValidFunc},
+		{"sidecar.agent.vaultproject.io/failure", alwaysValidFunc},
+		{"sidecar.agent.vaultproject.io/agent-config-storage", ValidateConfigStorage},
 	}
 
 	annotationPolicy        = annotationRegistry[0]
@@ -35,6 +64,14 @@ var (
 	annotationSecret        = annotationRegistry[2]
 	annotationVaultFileName = annotationRegistry[3]
 	annotationVaultRole     = annotationRegistry[4]
+	annotationInjection     = annotationRegistry[5]
+	annotationCPURequest    = annotationRegistry[6]
+	annotationCPULimit      = annotationRegistry[7]
+	annotationMemoryRequest = annotationRegistry[8]
+	annotationMemoryLimit   = annotationRegistry[9]
+	annotationMountPath     = annotationRegistry[10]
+	annotationFailure       = annotationRegistry[11]
+	annotationConfigStorage = annotationRegistry[12]
 
 	ignoredNamespaces = []string{
 		metav1.NamespaceSystem,
@@ -44,116 +81,261 @@ var (
 	log = logger.Log()
 )
 
+const (
+	// AnnotationPrefix is the common prefix of the webhook annotations
+	AnnotationPrefix = "sidecar.agent.vaultproject.io/"
+	// InjectedLabel is added to every injected pod, useful for auditing and selectors
+	InjectedLabel = "vault-agent-injected"
+)
+
 // Mutate AdmissionReview Request
-func (wk *WebHook) Mutate(context *gin.Context) {
+func (wk *WebHook) Mutate(c *gin.Context) {
 
 	var admissionReview v1.AdmissionReview
 
-	if err := context.ShouldBindJSON(&admissionReview); err == nil {
-		log.WithFields(logrus.Fields{
-			"AdmissionReview": admissionReview,
-		}).Debugln("AdmissionReview: ")
-		admissionReview.Response = wk.admit(admissionReview)
-		log.WithFields(logrus.Fields{
-			"AdmissionResponse": admissionReview.Response,
-		}).Debugln("AdmissionReview: ")
-		context.JSON(http.StatusOK, &admissionReview)
+	// continue the trace of the API server, when propagated
+	ctx, span := tracing.Start(tracing.Extract(c.Request), "mutate")
+	defer span.End()
+
+	// the admission has to answer before the API server gives up after the webhook timeout,
+	// the API calls still running when the budget is exceeded are cancelled
+	if wk.Budget > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, wk.Budget)
+		defer cancel()
+	}
+
+	if err := c.ShouldBindJSON(&admissionReview); err == nil {
+		admissionReview.Response = wk.admit(ctx, admissionReview)
+		span.SetAttributes(kv.Bool("allowed", admissionReview.Response.Allowed))
+		if log.IsLevelEnabled(logrus.DebugLevel) {
+			log.WithFields(logrus.Fields{
+				logger.FieldUID: admissionReview.Response.UID,
+				"allowed":       admissionReview.Response.Allowed,
+				"result":        admissionReview.Response.Result,
+				"patch":         wk.Redactor.JSON(admissionReview.Response.Patch),
+			}).Debugln("AdmissionResponse")
+		}
+		c.JSON(http.StatusOK, &admissionReview)
 	} else {
 		log.WithFields(logrus.Fields{
-			"Context": context,
-			"Error":   err,
-		}).Errorln("Mutate Request: ")
-		context.AbortWithStatusJSON(http.StatusBadRequest, ToAdmissionResponseError(err))
+			"clientIP": c.ClientIP(),
+			"error":    err,
+		}).Errorln("Mutate Request")
+		span.RecordError(ctx, err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, ToAdmissionResponseError("", err))
 	}
 
 }
 
-func (wk *WebHook) admit(ar v1.AdmissionReview) *v1.AdmissionResponse {
+func (wk *WebHook) admit(ctx context.Context, ar v1.AdmissionReview) (response *v1.AdmissionResponse) {
 	req := ar.Request
 	pod := corev1.Pod{}
 	var err error
-	var name string
 
 	if err = Pod(req.Object.Raw, &pod); err != nil {
-		return ToAdmissionResponseError(err)
+		return ToAdmissionResponseError(req.UID, err)
 	}
 
 	pod.Name = PotentialPodName(&pod.ObjectMeta)
 	pod.Namespace = PotentialNamespace(req, &pod)
 
-	log.WithFields(logrus.Fields{
-		"Kind":           req.Kind,
-		"Namespace":      req.Namespace,
-		"Name":           pod.Name,
-		"UID":            req.UID,
-		"PatchOperation": req.Operation,
-		"UserInfo":       req.UserInfo,
-	}).Infoln("AdmissionReview for")
+	ctx, span := tracing.Start(ctx, "admit",
+		kv.String(logger.FieldUID, string(req.UID)),
+		kv.String(logger.FieldNamespace, pod.Namespace),
+		kv.String(logger.FieldPod, pod.Name),
+		kv.String(logger.FieldOperation, string(req.Operation)),
+	)
+	defer func() {
+		span.SetAttributes(kv.String("outcome", auditOutcome(req, response)))
+		span.End()
+	}()
 
-	if !isRequired(ignoredNamespaces, &pod) {
-		log.WithFields(logrus.Fields{
-			"Kind":           req.Kind,
-			"Namespace":      req.Namespace,
-			"Name":           pod.Name,
-			"UID":            req.UID,
-			"PatchOperation": req.Operation,
-			"UserInfo":       req.UserInfo,
-		}).Infoln("Admission Not Required")
+	defer func() {
+		wk.audit(req, &pod, response)
+		wk.event(req, &pod, response)
+	}()
+
+	reqLog := requestLogger(req, &pod)
+	if log.IsLevelEnabled(logrus.DebugLevel) {
+		reqLog.WithField("object", wk.Redactor.Pod(&pod)).Debugln("AdmissionReview")
+	}
+	reqLog.Infoln("AdmissionReview for")
+
+	if req.Operation == v1.Update && isInjected(&pod) {
+		return wk.reinject(ctx, req, &pod)
+	}
+
+	// the pod spec is immutable once created, the pods not injected at creation, e.g. degraded, are left as is
+	if req.Operation != v1.Create || !isRequired(ignoredNamespaces, &pod, reqLog) {
+		reqLog.Infoln("Admission Not Required")
 		return &v1.AdmissionResponse{
 			Allowed: true,
 			UID:     req.UID,
 		}
 	}
 
+	if err = wk.SidecarConfig.Check(); err != nil {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+
+	mode := wk.failureMode(ctx, pod.Namespace)
+
+	if err = ValidateAnnotations(pod); err != nil {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+
 	//sidecar data
-	name, err = GetDeploymentName(pod.OwnerReferences[0].Name)
+	data, err := NewSidecarData(&pod, wk.SecurityContext, wk.ConfigStorage)
 	if err != nil {
-		return ToAdmissionResponseError(err)
+		return ToAdmissionResponseError(req.UID, err)
 	}
 
-	data := SidecarData{
-		Name:          name,
-		Container:     pod.Spec.Containers[0],
-		TokenVolume:   FindTokenVolumeName(pod.Spec.Volumes),
-		VaultSecret:   GetAnnotationValue(pod, annotationSecret, ""),
-		VaultFileName: GetAnnotationValue(pod, annotationVaultFileName, "application.yaml"),
-		VaultRole:     GetAnnotationValue(pod, annotationVaultRole, "example"),
+	// agent config
+	if err = checkBudget(ctx, "the agent config"); err != nil {
+		return wk.fail(ctx, req, &pod, mode, err)
 	}
-
-	// agent configMap
-	_, err = agentConfigMap(VaultAgentConfigPrefix, pod, wk, &data, false)
+	agentConfigName, err := agentConfig(ctx, VaultAgentConfigPrefix, pod, wk, data, false)
 	if err != nil {
-		return ToAdmissionResponseError(err)
+		return wk.fail(ctx, req, &pod, mode, err)
 	}
 
 	// ca-bundle
-	_, err = caBundleConfigMap(pod, wk, &data)
+	if err = checkBudget(ctx, "the CA bundle ConfigMap"); err != nil {
+		return wk.fail(ctx, req, &pod, mode, err)
+	}
+	_, err = caBundleConfigMap(ctx, pod, wk, data)
+	if err != nil {
+		return wk.fail(ctx, req, &pod, mode, err)
+	}
+
+	if err = checkBudget(ctx, "the sidecar template"); err != nil {
+		return wk.fail(ctx, req, &pod, mode, err)
+	}
+	sic, err := inject(ctx, data, wk.SidecarConfig)
 	if err != nil {
-		return ToAdmissionResponseError(err)
+		return ToAdmissionResponseError(req.UID, err)
+	}
+	if log.IsLevelEnabled(logrus.DebugLevel) {
+		if rendered, err := json.Marshal(sic); err == nil {
+			reqLog.WithField("sidecar", wk.Redactor.JSON(rendered)).Debugln("SidecarInject")
+		}
+	}
+	if data.ConfigStorage == ConfigStorageSecret {
+		useSecretVolume(sic, agentConfigName)
+	}
+	applySecurityContext(sic, &pod, data.SecurityContext)
+	if err = ValidateMountPaths(pod.Spec.Containers[0], sic.VolumeMount); err != nil {
+		return ToAdmissionResponseError(req.UID, err)
 	}
 
-	wk.VaultConfig, err = inject(&data, wk.SidecarConfig)
+	// limit range
+	if err = checkBudget(ctx, "the LimitRanges"); err != nil {
+		return wk.fail(ctx, req, &pod, mode, err)
+	}
+	if err = fitLimitRanges(sic, namespaceLimitRanges(ctx, wk.Client, pod.Namespace)); err != nil {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+	injection := InjectionDetails{
+		ConfigHash: wk.SidecarConfig.Hash,
+		DataHash:   DataHash(wk.SidecarConfig, &pod),
+		Version:    version.Version,
+		Secrets:    []string{data.VaultSecret},
+		Containers: ContainerNames(sic),
+	}
+	injection.setAgentConfig(data.ConfigStorage, agentConfigName)
+	details, err := InjectionDetailsValue(injection)
 	if err != nil {
-		return ToAdmissionResponseError(err)
+		return ToAdmissionResponseError(req.UID, err)
 	}
-	annotations := map[string]string{annotationStatus.name: "injected"}
+
+	annotations := seccompAnnotations(sic, data.SecurityContext)
+	annotations[annotationStatus.name] = "injected"
+	annotations[annotationInjection.name] = details
+	labels := map[string]string{InjectedLabel: "true"}
 
 	//patch
-	patches, err := CreatePatch(&pod, wk.VaultConfig, annotations)
+	if err = checkBudget(ctx, "the patch"); err != nil {
+		return wk.fail(ctx, req, &pod, mode, err)
+	}
+	patches, err := CreatePatch(ctx, &pod, sic, annotations, labels)
 	if err != nil {
-		return ToAdmissionResponseError(err)
+		return ToAdmissionResponseError(req.UID, err)
 	}
 
-	log.Debugf("AdmissionResponse: patch=%v\n", string(patches))
+	reqLog.WithFields(logrus.Fields{"agentConfig": agentConfigName, "storage": data.ConfigStorage}).Infoln("AdmissionResponse Allowed for")
 
-	log.WithFields(logrus.Fields{
-		"Kind":           req.Kind,
-		"Namespace":      req.Namespace,
-		"Name":           pod.Name,
-		"UID":            req.UID,
-		"PatchOperation": req.Operation,
-		"UserInfo":       req.UserInfo,
-	}).Infoln("AdmissionResponse Allowed for")
+	return &v1.AdmissionResponse{
+		Allowed: true,
+		UID:     req.UID,
+		Patch:   patches,
+		PatchType: func() *v1.PatchType {
+			pt := v1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
+
+// reinject compares the configuration used at injection time with the current one
+// and regenerates the agent config when the pod annotations or the sidecar config changed
+func (wk *WebHook) reinject(ctx context.Context, req *v1.AdmissionRequest, pod *corev1.Pod) *v1.AdmissionResponse {
+	if err := wk.SidecarConfig.Check(); err != nil {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+
+	details, err := GetInjectionDetails(*pod)
+	if err != nil {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+
+	for _, name := range details.Containers {
+		if !hasContainer(pod, name) {
+			return ToAdmissionResponseError(req.UID, fmt.Errorf("Injected container %s cannot be removed while %s is injected", name, annotationStatus.name))
+		}
+	}
+
+	hash := DataHash(wk.SidecarConfig, pod)
+	if hash == details.DataHash {
+		requestLogger(req, pod).Infoln("Injection up to date")
+		return &v1.AdmissionResponse{
+			Allowed: true,
+			UID:     req.UID,
+		}
+	}
+
+	// the volumes of the pod cannot change, the agent config stays in the storage used at injection time
+	data, err := NewSidecarData(pod, wk.SecurityContext, wk.ConfigStorage)
+	if err != nil {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+	data.ConfigStorage = details.agentConfigStorage()
+
+	mode := wk.failureMode(ctx, pod.Namespace)
+	if err = checkBudget(ctx, "the agent config"); err != nil {
+		return wk.fail(ctx, req, pod, mode, err)
+	}
+	agentConfigName, err := agentConfig(ctx, VaultAgentConfigPrefix, *pod, wk, data, false)
+	if err != nil {
+		return wk.fail(ctx, req, pod, mode, err)
+	}
+
+	details.ConfigHash = wk.SidecarConfig.Hash
+	details.DataHash = hash
+	details.Version = version.Version
+	details.Secrets = []string{data.VaultSecret}
+	details.setAgentConfig(data.ConfigStorage, agentConfigName)
+
+	value, err := InjectionDetailsValue(*details)
+	if err != nil {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+
+	patches, err := json.Marshal(kube.UpdateAnnotation(pod.Annotations, map[string]string{annotationInjection.name: value}))
+	if err != nil {
+		return ToAdmissionResponseError(req.UID, err)
+	}
+
+	requestLogger(req, pod).WithFields(logrus.Fields{"agentConfig": agentConfigName, "storage": data.ConfigStorage}).Infoln("Injection updated for")
 
 	return &v1.AdmissionResponse{
 		Allowed: true,
@@ -165,3 +347,15 @@ func (wk *WebHook) admit(ar v1.AdmissionReview) *v1.AdmissionResponse {
 		}(),
 	}
 }
+
+// requestLogger returns a logger with the fields identifying the admission request
+func requestLogger(req *v1.AdmissionRequest, pod *corev1.Pod) *logrus.Entry {
+	return log.WithFields(logrus.Fields{
+		logger.FieldUID:       req.UID,
+		logger.FieldNamespace: pod.Namespace,
+		logger.FieldPod:       pod.Name,
+		logger.FieldOwner:     PodOwner(pod),
+		logger.FieldOperation: req.Operation,
+		logger.FieldUser:      req.UserInfo.Username,
+	})
+}
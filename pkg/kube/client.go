@@ -1,21 +1,77 @@
 package kube
 
 import (
+	"io/ioutil"
+	"strings"
+	"sync"
+
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
-// Client creates Kubernetes Client with Inner Cluster Config
-func Client() *kubernetes.Clientset {
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		panic(err.Error())
+var (
+	kubeconfig string
+
+	once      sync.Once
+	clientset *kubernetes.Clientset
+	clientErr error
+)
+
+// SetKubeconfig sets the kubeconfig file of the shared client, the in cluster configuration is used when empty.
+// It has to be called before the first NewClient call.
+func SetKubeconfig(path string) {
+	kubeconfig = path
+}
+
+// Config returns the client configuration from the kubeconfig file or from the cluster
+func Config() (*rest.Config, error) {
+	if kubeconfig == "" {
+		return rest.InClusterConfig()
 	}
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// NewClient returns the Kubernetes Client shared by the webhook, created on the first call
+func NewClient() (*kubernetes.Clientset, error) {
+	once.Do(func() {
+		var config *rest.Config
+		config, clientErr = Config()
+		if clientErr != nil {
+			return
+		}
+		clientset, clientErr = kubernetes.NewForConfig(config)
+	})
+	return clientset, clientErr
+}
+
+// Ping verifies the Kubernetes API is reachable
+func Ping() error {
+	clientset, err := NewClient()
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	_, err = clientset.Discovery().ServerVersion()
+	return err
+}
+
+// Namespace returns the namespace of the running pod from the service account,
+// or the namespace of the kubeconfig current context when running outside the cluster
+func Namespace() string {
+	data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if kubeconfig == "" {
+		return ""
 	}
 
-	return clientset
+	namespace, _, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{},
+	).Namespace()
+	if err != nil {
+		return ""
+	}
+	return namespace
 }
@@ -0,0 +1,23 @@
+package kube
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventRecorder creates a Kubernetes EventRecorder for the component
+func EventRecorder(component string) (record.EventRecorder, error) {
+	clientset, err := NewClient()
+	if err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: clientset.CoreV1().Events(""),
+	})
+
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component}), nil
+}
@@ -0,0 +1,66 @@
+package kube
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// ManagedByLabel identifies the resources created by the webhook
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the value of ManagedByLabel for the resources created by the webhook
+	ManagedByValue = "vault-agent-webhook"
+)
+
+// Informers caches the resources read on every admission
+type Informers struct {
+	ConfigMaps corelisters.ConfigMapLister
+	Namespaces corelisters.NamespaceLister
+
+	factories []informers.SharedInformerFactory
+	synced    []cache.InformerSynced
+}
+
+// NewInformers creates the informers of the ConfigMaps managed by the webhook and of the Namespaces
+func NewInformers(client kubernetes.Interface, resync time.Duration) *Informers {
+	managed := informers.NewSharedInformerFactoryWithOptions(client, resync,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.SelectorFromSet(labels.Set{ManagedByLabel: ManagedByValue}).String()
+		}),
+	)
+	all := informers.NewSharedInformerFactory(client, resync)
+
+	configMaps := managed.Core().V1().ConfigMaps()
+	namespaces := all.Core().V1().Namespaces()
+
+	return &Informers{
+		ConfigMaps: configMaps.Lister(),
+		Namespaces: namespaces.Lister(),
+		factories:  []informers.SharedInformerFactory{managed, all},
+		synced:     []cache.InformerSynced{configMaps.Informer().HasSynced, namespaces.Informer().HasSynced},
+	}
+}
+
+// Start runs the informers until stop is closed
+func (i *Informers) Start(stop <-chan struct{}) {
+	for _, factory := range i.factories {
+		factory.Start(stop)
+	}
+}
+
+// Synced verifies the caches completed the initial list
+func (i *Informers) Synced() error {
+	for _, synced := range i.synced {
+		if !synced() {
+			return fmt.Errorf("Informer caches not synced")
+		}
+	}
+	return nil
+}
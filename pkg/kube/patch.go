@@ -1,6 +1,8 @@
 package kube
 
 import (
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
 )
 
@@ -71,25 +73,65 @@ func AddVolumeMount(target, added []corev1.VolumeMount, basePath string) (patch
 	return patch
 }
 
+// AddPodSecurityContext prepare patch operation to add the FSGroup of the pod security context
+func AddPodSecurityContext(target, added *corev1.PodSecurityContext, basePath string) (patch []PatchOperation) {
+	if added == nil || added.FSGroup == nil {
+		return patch
+	}
+	if target == nil {
+		return append(patch, PatchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: corev1.PodSecurityContext{FSGroup: added.FSGroup},
+		})
+	}
+	if target.FSGroup != nil {
+		return patch
+	}
+	return append(patch, PatchOperation{
+		Op:    "add",
+		Path:  basePath + "/fsGroup",
+		Value: *added.FSGroup,
+	})
+}
+
 // UpdateAnnotation prepare patch operation to add/replace annotation map
 func UpdateAnnotation(target map[string]string, added map[string]string) (patch []PatchOperation) {
+	return updateMetadata(target, added, "/metadata/annotations")
+}
+
+// UpdateLabel prepare patch operation to add/replace label map
+func UpdateLabel(target map[string]string, added map[string]string) (patch []PatchOperation) {
+	return updateMetadata(target, added, "/metadata/labels")
+}
+
+// updateMetadata prepare patch operation to add/replace a metadata map such as annotations or labels
+func updateMetadata(target map[string]string, added map[string]string, basePath string) (patch []PatchOperation) {
+	if len(added) == 0 {
+		return patch
+	}
+	if target == nil {
+		return append(patch, PatchOperation{
+			Op:    "add",
+			Path:  basePath,
+			Value: added,
+		})
+	}
 	for key, value := range added {
-		if target == nil || target[key] == "" {
-			target = map[string]string{}
-			patch = append(patch, PatchOperation{
-				Op:   "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{
-					key: value,
-				},
-			})
-		} else {
-			patch = append(patch, PatchOperation{
-				Op:    "replace",
-				Path:  "/metadata/annotations/" + key,
-				Value: value,
-			})
+		op := "add"
+		if _, ok := target[key]; ok {
+			op = "replace"
 		}
+		patch = append(patch, PatchOperation{
+			Op:    op,
+			Path:  basePath + "/" + escapeJSONPointer(key),
+			Value: value,
+		})
 	}
 	return patch
 }
+
+// escapeJSONPointer escapes a key to be used as JSON Pointer reference token (RFC 6901)
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,110 @@
+package kube
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// The typed clients do not accept a context, the requests below are built on the REST client
+// to be cancelled when the admission deadline is exceeded.
+
+// GetConfigMap reads a ConfigMap from the API server
+func GetConfigMap(ctx context.Context, client kubernetes.Interface, namespace, name string) (*corev1.ConfigMap, error) {
+	result := &corev1.ConfigMap{}
+	return result, get(ctx, client, "configmaps", namespace, name, result)
+}
+
+// CreateConfigMap creates a ConfigMap
+func CreateConfigMap(ctx context.Context, client kubernetes.Interface, configMap *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	result := &corev1.ConfigMap{}
+	err := client.CoreV1().RESTClient().Post().
+		Context(ctx).
+		Namespace(configMap.Namespace).
+		Resource("configmaps").
+		Body(configMap).
+		Do().
+		Into(result)
+	return result, err
+}
+
+// UpdateConfigMap updates a ConfigMap
+func UpdateConfigMap(ctx context.Context, client kubernetes.Interface, configMap *corev1.ConfigMap) (*corev1.ConfigMap, error) {
+	result := &corev1.ConfigMap{}
+	err := client.CoreV1().RESTClient().Put().
+		Context(ctx).
+		Namespace(configMap.Namespace).
+		Resource("configmaps").
+		Name(configMap.Name).
+		Body(configMap).
+		Do().
+		Into(result)
+	return result, err
+}
+
+// GetSecret reads a Secret from the API server
+func GetSecret(ctx context.Context, client kubernetes.Interface, namespace, name string) (*corev1.Secret, error) {
+	result := &corev1.Secret{}
+	return result, get(ctx, client, "secrets", namespace, name, result)
+}
+
+// CreateSecret creates a Secret
+func CreateSecret(ctx context.Context, client kubernetes.Interface, secret *corev1.Secret) (*corev1.Secret, error) {
+	result := &corev1.Secret{}
+	err := client.CoreV1().RESTClient().Post().
+		Context(ctx).
+		Namespace(secret.Namespace).
+		Resource("secrets").
+		Body(secret).
+		Do().
+		Into(result)
+	return result, err
+}
+
+// UpdateSecret updates a Secret
+func UpdateSecret(ctx context.Context, client kubernetes.Interface, secret *corev1.Secret) (*corev1.Secret, error) {
+	result := &corev1.Secret{}
+	err := client.CoreV1().RESTClient().Put().
+		Context(ctx).
+		Namespace(secret.Namespace).
+		Resource("secrets").
+		Name(secret.Name).
+		Body(secret).
+		Do().
+		Into(result)
+	return result, err
+}
+
+// GetNamespace reads a Namespace from the API server
+func GetNamespace(ctx context.Context, client kubernetes.Interface, name string) (*corev1.Namespace, error) {
+	result := &corev1.Namespace{}
+	return result, get(ctx, client, "namespaces", "", name, result)
+}
+
+// ListLimitRanges lists the LimitRanges of a namespace
+func ListLimitRanges(ctx context.Context, client kubernetes.Interface, namespace string) (*corev1.LimitRangeList, error) {
+	result := &corev1.LimitRangeList{}
+	err := client.CoreV1().RESTClient().Get().
+		Context(ctx).
+		Namespace(namespace).
+		Resource("limitranges").
+		VersionedParams(&metav1.ListOptions{}, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return result, err
+}
+
+func get(ctx context.Context, client kubernetes.Interface, resource, namespace, name string, result runtime.Object) error {
+	return client.CoreV1().RESTClient().Get().
+		Context(ctx).
+		Namespace(namespace).
+		Resource(resource).
+		Name(name).
+		VersionedParams(&metav1.GetOptions{}, scheme.ParameterCodec).
+		Do().
+		Into(result)
+}